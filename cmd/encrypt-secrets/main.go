@@ -0,0 +1,69 @@
+// Command encrypt-secrets encrypts the TOTP secrets still stored in plaintext, and re-encrypts
+// the ones encrypted under an older key version after a new key was added to TFA_ENCRYPTION_KEYS.
+package main
+
+import (
+	"go-auth/config"
+	"go-auth/db"
+	"go-auth/models"
+	"go-auth/utils"
+	"log"
+)
+
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+
+	db.Connect(cfg.DatabaseURL)
+
+	var users []models.User
+	if err := db.DB.Where("tfa_secret <> '' OR tfa_pending_secret <> ''").Find(&users).Error; err != nil {
+		log.Fatal("Failed to load users: ", err)
+	}
+
+	updated := 0
+	for _, user := range users {
+		updates := map[string]interface{}{}
+
+		for column, stored := range map[string]string{
+			"tfa_secret":         user.TFASecret,
+			"tfa_pending_secret": user.TFAPendingSecret,
+		} {
+			if !utils.NeedsReencryption(cfg.Encryption, stored) {
+				continue
+			}
+
+			secret, err := utils.DecryptSecret(cfg.Encryption, stored, user.Id.String())
+			if err != nil {
+				log.Fatalf("Failed to decrypt %s of user %s: %v", column, user.Id, err)
+			}
+
+			encrypted, err := utils.EncryptSecret(cfg.Encryption, secret, user.Id.String())
+			if err != nil {
+				log.Fatalf("Failed to encrypt %s of user %s: %v", column, user.Id, err)
+			}
+			updates[column] = encrypted
+		}
+
+		if len(updates) == 0 {
+			continue
+		}
+
+		// Only overwrite values nobody changed since they were read
+		result := db.DB.Model(&models.User{}).
+			Where("id = ? AND tfa_secret = ? AND tfa_pending_secret = ?", user.Id, user.TFASecret, user.TFAPendingSecret).
+			Updates(updates)
+		if result.Error != nil {
+			log.Fatalf("Failed to save secrets of user %s: %v", user.Id, result.Error)
+		}
+		if result.RowsAffected == 0 {
+			log.Printf("Skipped user %s, their secrets changed meanwhile; run again to pick them up", user.Id)
+			continue
+		}
+		updated++
+	}
+
+	log.Printf("Encrypted the 2FA secrets of %d of %d users", updated, len(users))
+}
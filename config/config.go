@@ -0,0 +1,582 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gofiber/fiber/v2"
+	"github.com/joho/godotenv"
+	"github.com/pquerna/otp"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the application settings
+type Config struct {
+	Port        string // Port the HTTP server listens on
+	AppHost     string // Host used to build links sent by email
+	DatabaseURL string
+	AdminAPIKey string // Unlocks the admin routes, which are disabled when empty
+
+	// Client ID to secret of the resource servers allowed to introspect tokens
+	IntrospectionClients map[string]string
+
+	AccessTokenTTL  time.Duration // Lifetime of access tokens
+	RefreshTokenTTL time.Duration // Lifetime of a session without remember me
+	RememberMeTTL   time.Duration // Lifetime of a session with remember me
+	ResetTokenTTL   time.Duration // Lifetime of password reset links
+	MagicLinkTTL    time.Duration // Lifetime of passwordless login links
+
+	MFAChallengeTTL time.Duration // Time allowed between the password check and the second factor
+	MFAMaxAttempts  int           // Codes that may be tried against a single MFA challenge
+
+	TrustedDeviceTTL time.Duration // How long a trusted browser skips the second factor, never when zero
+
+	EmailVerification EmailVerification
+
+	JWT        JWT
+	SMTP       SMTP
+	Password   PasswordPolicy
+	Argon2     Argon2
+	TOTP       TOTP
+	EmailOTP   EmailOTP
+	WebAuthn   WebAuthn
+	Encryption Encryption
+}
+
+// JWT holds the token signing settings
+type JWT struct {
+	SigningAlg            string // HS256, RS256, ES256 or EdDSA
+	SecretAccess          string // Signs access tokens with HS256
+	SecretRefresh         string // Signs refresh tokens
+	SecretRefreshPrevious []string
+	PrivateKey            string // PEM private key for the asymmetric algorithms
+	PrivateKeyFile        string
+	KeyID                 string
+	KeysDir               string        // Enables key rotation, storing the keys in this directory
+	KeyRetention          time.Duration // How long a replaced key keeps verifying tokens
+	KeyRotationInterval   time.Duration // Rotate automatically, never when zero
+	Issuer                string
+	Audience              []string
+}
+
+// PasswordPolicy holds the rules new passwords have to follow
+type PasswordPolicy struct {
+	MinLength       int
+	MaxLength       int
+	RequiredClasses []string // Any of lower, upper, digit and symbol
+	MinScore        int      // Lowest accepted zxcvbn strength score, from 0 to 4
+	BreachedList    string   // SHA-1 hash list file, or directory of range files, of breached passwords
+}
+
+// EmailVerification holds the settings of the links that confirm a registered email address
+type EmailVerification struct {
+	Required       bool          // Refuses password and passkey logins until the address is verified, which a magic link also does
+	TTL            time.Duration // How long a link stays valid
+	ResendInterval time.Duration // Minimum time between two links sent to the same address
+}
+
+// Argon2 holds the Argon2id parameters of new password hashes
+type Argon2 struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32 // Bytes
+	KeyLength   uint32 // Bytes
+}
+
+// TOTP holds the settings of authenticator app codes
+type TOTP struct {
+	Period      uint          // Seconds each code is valid for
+	Skew        uint          // Periods before and after the current one that are still accepted
+	Digits      otp.Digits    // Length of the codes
+	Algorithm   otp.Algorithm // HMAC algorithm, most authenticator apps only support SHA1
+	MaxFailures int           // Failed codes in a row before the second factor is locked
+	Lockout     time.Duration // How long the second factor stays locked
+}
+
+// EmailOTP holds the settings of the codes sent by email as a second factor
+type EmailOTP struct {
+	Digits         int           // Length of the codes
+	TTL            time.Duration // How long a code stays valid
+	ResendInterval time.Duration // Minimum time between two codes sent to the same user
+}
+
+// WebAuthn holds the relying party settings of passkeys and security keys
+type WebAuthn struct {
+	RPID          string        // Domain the credentials are scoped to, they cannot be used on other domains
+	RPDisplayName string        // Shown by the browser while registering
+	RPOrigins     []string      // Origins the ceremonies may be performed from
+	Timeout       time.Duration // Time allowed to complete a registration or login ceremony
+}
+
+// Encryption holds the keys that encrypt secrets stored in the database, such as TOTP secrets
+type Encryption struct {
+	Keys          map[int][]byte // AES-256 keys by version, old versions are only used to decrypt
+	ActiveVersion int            // Version new secrets are encrypted with
+}
+
+// SMTP holds the settings of the mail server used for outgoing email
+type SMTP struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	From     string
+}
+
+// Load reads the settings from the environment and .env, then from the optional
+// YAML or TOML file named by CONFIG_FILE, falling back to defaults for anything unset.
+// Config file keys are the same as the environment variable names, in any case.
+func Load() (*Config, error) {
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: No .env file found, using system environment variables")
+	}
+
+	file, err := readFile(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &loader{file: file}
+
+	cfg := &Config{
+		Port:        l.string("PORT", "8000"),
+		DatabaseURL: l.string("DATABASE_URL", ""),
+		AdminAPIKey: l.string("ADMIN_API_KEY", ""),
+
+		IntrospectionClients: l.credentials("INTROSPECTION_CLIENTS"),
+
+		AccessTokenTTL:  l.duration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL: l.duration("REFRESH_TOKEN_TTL", 7*24*time.Hour),
+		RememberMeTTL:   l.duration("REMEMBER_ME_TTL", 365*24*time.Hour),
+		ResetTokenTTL:   l.duration("RESET_TOKEN_TTL", 30*time.Minute),
+		MagicLinkTTL:    l.duration("MAGIC_LINK_TTL", 15*time.Minute),
+
+		MFAChallengeTTL: l.duration("MFA_CHALLENGE_TTL", 5*time.Minute),
+		MFAMaxAttempts:  l.int("MFA_MAX_ATTEMPTS", 5),
+
+		TrustedDeviceTTL: l.duration("TRUSTED_DEVICE_TTL", 30*24*time.Hour),
+
+		EmailVerification: EmailVerification{
+			Required:       l.bool("EMAIL_VERIFICATION_REQUIRED", false),
+			TTL:            l.duration("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+			ResendInterval: l.duration("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute),
+		},
+
+		JWT: JWT{
+			SigningAlg:            l.string("JWT_SIGNING_ALG", "HS256"),
+			SecretAccess:          l.string("JWT_SECRET_ACCESS", ""),
+			SecretRefresh:         l.string("JWT_SECRET_REFRESH", ""),
+			SecretRefreshPrevious: l.list("JWT_SECRET_REFRESH_PREVIOUS"),
+			PrivateKey:            l.string("JWT_PRIVATE_KEY", ""),
+			PrivateKeyFile:        l.string("JWT_PRIVATE_KEY_FILE", ""),
+			KeyID:                 l.string("JWT_KEY_ID", ""),
+			KeysDir:               l.string("JWT_KEYS_DIR", ""),
+			KeyRetention:          l.duration("JWT_KEY_RETENTION", 24*time.Hour),
+			KeyRotationInterval:   l.duration("JWT_KEY_ROTATION_INTERVAL", 0),
+			Issuer:                l.string("JWT_ISSUER", ""),
+			Audience:              l.list("JWT_AUDIENCE"),
+		},
+
+		Password: PasswordPolicy{
+			MinLength:       l.int("PASSWORD_MIN_LENGTH", 8),
+			MaxLength:       l.int("PASSWORD_MAX_LENGTH", 128),
+			RequiredClasses: l.list("PASSWORD_REQUIRED_CLASSES"),
+			MinScore:        l.int("PASSWORD_MIN_SCORE", 3),
+			BreachedList:    l.string("PASSWORD_BREACHED_LIST", ""),
+		},
+
+		Argon2: Argon2{
+			Memory:      uint32(l.int("ARGON2_MEMORY", 64*1024)),
+			Iterations:  uint32(l.int("ARGON2_ITERATIONS", 3)),
+			Parallelism: uint8(l.int("ARGON2_PARALLELISM", 4)),
+			SaltLength:  uint32(l.int("ARGON2_SALT_LENGTH", 16)),
+			KeyLength:   uint32(l.int("ARGON2_KEY_LENGTH", 32)),
+		},
+
+		TOTP: TOTP{
+			Period:      uint(l.int("TOTP_PERIOD", 30)),
+			Skew:        uint(l.int("TOTP_SKEW", 1)),
+			Digits:      otp.Digits(l.int("TOTP_DIGITS", 6)),
+			Algorithm:   l.totpAlgorithm("TOTP_ALGORITHM"),
+			MaxFailures: l.int("TOTP_MAX_FAILURES", 5),
+			Lockout:     l.duration("TOTP_LOCKOUT", 15*time.Minute),
+		},
+
+		EmailOTP: EmailOTP{
+			Digits:         l.int("EMAIL_OTP_DIGITS", 6),
+			TTL:            l.duration("EMAIL_OTP_TTL", 10*time.Minute),
+			ResendInterval: l.duration("EMAIL_OTP_RESEND_INTERVAL", time.Minute),
+		},
+
+		Encryption: l.encryption("TFA_ENCRYPTION_KEYS", "TFA_ENCRYPTION_KEY_VERSION"),
+
+		SMTP: SMTP{
+			Host:     l.string("SMTP_HOST", ""),
+			Port:     l.string("SMTP_PORT", "25"),
+			User:     l.string("SMTP_USER", ""),
+			Password: l.string("SMTP_PASSWORD", ""),
+			From:     l.string("SMTP_FROM", ""),
+		},
+	}
+	cfg.AppHost = l.string("APP_HOST", "localhost:"+cfg.Port)
+
+	// The relying party defaults to the host that serves the application
+	cfg.WebAuthn = WebAuthn{
+		RPID:          l.string("WEBAUTHN_RP_ID", strings.Split(cfg.AppHost, ":")[0]),
+		RPDisplayName: l.string("WEBAUTHN_RP_NAME", "Go Auth"),
+		RPOrigins:     l.list("WEBAUTHN_RP_ORIGINS"),
+		Timeout:       l.duration("WEBAUTHN_TIMEOUT", 5*time.Minute),
+	}
+	if len(cfg.WebAuthn.RPOrigins) == 0 {
+		cfg.WebAuthn.RPOrigins = []string{"https://" + cfg.AppHost}
+	}
+
+	if len(l.errors) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(l.errors, "; "))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate rejects settings the application cannot safely start with
+func (cfg *Config) Validate() error {
+	var problems []string
+
+	required := map[string]string{
+		"DATABASE_URL":       cfg.DatabaseURL,
+		"JWT_SECRET_REFRESH": cfg.JWT.SecretRefresh,
+		"SMTP_HOST":          cfg.SMTP.Host,
+		"SMTP_FROM":          cfg.SMTP.From,
+	}
+	if cfg.JWT.SigningAlg == "HS256" {
+		required["JWT_SECRET_ACCESS"] = cfg.JWT.SecretAccess
+	}
+	for name, value := range required {
+		if strings.TrimSpace(value) == "" {
+			problems = append(problems, name+" is required")
+		}
+	}
+
+	switch cfg.JWT.SigningAlg {
+	case "HS256":
+	case "RS256", "ES256", "EdDSA":
+		if cfg.JWT.PrivateKey == "" && cfg.JWT.PrivateKeyFile == "" && cfg.JWT.KeysDir == "" {
+			problems = append(problems, "JWT_PRIVATE_KEY, JWT_PRIVATE_KEY_FILE or JWT_KEYS_DIR is required for "+cfg.JWT.SigningAlg)
+		}
+	default:
+		problems = append(problems, "unsupported JWT_SIGNING_ALG: "+cfg.JWT.SigningAlg)
+	}
+
+	if cfg.JWT.SecretRefresh != "" && cfg.JWT.SecretRefresh == cfg.JWT.SecretAccess {
+		problems = append(problems, "JWT_SECRET_REFRESH must differ from JWT_SECRET_ACCESS")
+	}
+
+	if cfg.AccessTokenTTL <= 0 || cfg.RefreshTokenTTL <= 0 || cfg.RememberMeTTL <= 0 || cfg.ResetTokenTTL <= 0 || cfg.MagicLinkTTL <= 0 {
+		problems = append(problems, "token lifetimes must be positive")
+	} else {
+		if cfg.AccessTokenTTL >= cfg.RefreshTokenTTL {
+			problems = append(problems, "ACCESS_TOKEN_TTL must be shorter than REFRESH_TOKEN_TTL")
+		}
+		if cfg.RememberMeTTL < cfg.RefreshTokenTTL {
+			problems = append(problems, "REMEMBER_ME_TTL must not be shorter than REFRESH_TOKEN_TTL")
+		}
+	}
+
+	if cfg.MFAChallengeTTL <= 0 {
+		problems = append(problems, "MFA_CHALLENGE_TTL must be positive")
+	}
+	if cfg.MFAMaxAttempts < 1 {
+		problems = append(problems, "MFA_MAX_ATTEMPTS must be at least 1")
+	}
+	if cfg.TrustedDeviceTTL < 0 {
+		problems = append(problems, "TRUSTED_DEVICE_TTL must not be negative")
+	}
+	if cfg.EmailVerification.TTL <= 0 || cfg.EmailVerification.ResendInterval < 0 {
+		problems = append(problems, "EMAIL_VERIFICATION_TTL must be positive and EMAIL_VERIFICATION_RESEND_INTERVAL must not be negative")
+	}
+
+	if cfg.Password.MinLength < 1 || cfg.Password.MaxLength < cfg.Password.MinLength {
+		problems = append(problems, "PASSWORD_MIN_LENGTH must be at least 1 and not more than PASSWORD_MAX_LENGTH")
+	}
+	for _, class := range cfg.Password.RequiredClasses {
+		if class != "lower" && class != "upper" && class != "digit" && class != "symbol" {
+			problems = append(problems, "PASSWORD_REQUIRED_CLASSES can only contain lower, upper, digit and symbol")
+			break
+		}
+	}
+	if cfg.Password.MinScore < 0 || cfg.Password.MinScore > 4 {
+		problems = append(problems, "PASSWORD_MIN_SCORE must be between 0 and 4")
+	}
+
+	if cfg.Argon2.Iterations < 1 || cfg.Argon2.Parallelism < 1 || cfg.Argon2.Memory < 8*uint32(cfg.Argon2.Parallelism) {
+		problems = append(problems, "ARGON2_ITERATIONS and ARGON2_PARALLELISM must be at least 1 and ARGON2_MEMORY at least 8 KiB per thread")
+	}
+	if cfg.Argon2.SaltLength < 8 || cfg.Argon2.KeyLength < 16 {
+		problems = append(problems, "ARGON2_SALT_LENGTH must be at least 8 and ARGON2_KEY_LENGTH at least 16")
+	}
+
+	if cfg.TOTP.Period == 0 || cfg.TOTP.Period > 300 {
+		problems = append(problems, "TOTP_PERIOD must be between 1 and 300 seconds")
+	}
+	if cfg.TOTP.Skew > 10 {
+		problems = append(problems, "TOTP_SKEW must not be more than 10")
+	}
+	if cfg.TOTP.Digits != otp.DigitsSix && cfg.TOTP.Digits != otp.DigitsEight {
+		problems = append(problems, "TOTP_DIGITS must be 6 or 8")
+	}
+	if cfg.TOTP.MaxFailures < 1 || cfg.TOTP.Lockout <= 0 {
+		problems = append(problems, "TOTP_MAX_FAILURES and TOTP_LOCKOUT must be positive")
+	}
+
+	if cfg.EmailOTP.Digits < 6 || cfg.EmailOTP.Digits > 10 {
+		problems = append(problems, "EMAIL_OTP_DIGITS must be between 6 and 10")
+	}
+	if cfg.EmailOTP.TTL <= 0 || cfg.EmailOTP.ResendInterval < 0 {
+		problems = append(problems, "EMAIL_OTP_TTL must be positive and EMAIL_OTP_RESEND_INTERVAL must not be negative")
+	}
+
+	if cfg.WebAuthn.RPID == "" {
+		problems = append(problems, "WEBAUTHN_RP_ID is required")
+	}
+	if cfg.WebAuthn.Timeout <= 0 {
+		problems = append(problems, "WEBAUTHN_TIMEOUT must be positive")
+	}
+
+	if len(cfg.Encryption.Keys) == 0 {
+		problems = append(problems, "TFA_ENCRYPTION_KEYS is required")
+	} else if _, ok := cfg.Encryption.Keys[cfg.Encryption.ActiveVersion]; !ok {
+		problems = append(problems, "TFA_ENCRYPTION_KEY_VERSION must be one of the TFA_ENCRYPTION_KEYS versions")
+	}
+
+	// A replaced key has to outlive the access tokens it signed
+	if cfg.JWT.KeysDir != "" && cfg.JWT.KeyRetention < cfg.AccessTokenTTL {
+		problems = append(problems, "JWT_KEY_RETENTION must not be shorter than ACCESS_TOKEN_TTL")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// SessionTTL returns how long a new session lives, depending on remember me
+func (cfg *Config) SessionTTL(rememberMe bool) time.Duration {
+	if rememberMe {
+		return cfg.RememberMeTTL
+	}
+	return cfg.RefreshTokenTTL
+}
+
+// ParseDuration accepts everything time.ParseDuration does plus a "d" suffix for days, e.g. "30d"
+func ParseDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// Middleware makes cfg available to every handler through Get
+func Middleware(cfg *Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("config", cfg)
+		return c.Next()
+	}
+}
+
+// Get returns the settings stored by Middleware
+func Get(c *fiber.Ctx) *Config {
+	return c.Locals("config").(*Config)
+}
+
+// readFile reads a flat YAML or TOML file into upper-cased keys
+func readFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	if path == "" {
+		return values, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &raw)
+	case ".toml":
+		err = toml.Unmarshal(content, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file format: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for key, value := range raw {
+		// Lists are joined the same way they are written in the environment
+		if list, ok := value.([]interface{}); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		}
+		values[strings.ToUpper(key)] = fmt.Sprint(value)
+	}
+
+	return values, nil
+}
+
+// loader looks settings up in the environment first and the config file second
+type loader struct {
+	file   map[string]string
+	errors []string
+}
+
+func (l *loader) lookup(name string) (string, bool) {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value, true
+	}
+	value, ok := l.file[name]
+	return value, ok && value != ""
+}
+
+func (l *loader) string(name, fallback string) string {
+	if value, ok := l.lookup(name); ok {
+		return value
+	}
+	return fallback
+}
+
+func (l *loader) duration(name string, fallback time.Duration) time.Duration {
+	value, ok := l.lookup(name)
+	if !ok {
+		return fallback
+	}
+
+	duration, err := ParseDuration(value)
+	if err != nil {
+		l.errors = append(l.errors, fmt.Sprintf("invalid %s: %v", name, err))
+		return fallback
+	}
+	return duration
+}
+
+func (l *loader) int(name string, fallback int) int {
+	value, ok := l.lookup(name)
+	if !ok {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		l.errors = append(l.errors, fmt.Sprintf("invalid %s: %v", name, err))
+		return fallback
+	}
+	return n
+}
+
+func (l *loader) bool(name string, fallback bool) bool {
+	value, ok := l.lookup(name)
+	if !ok {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		l.errors = append(l.errors, fmt.Sprintf("invalid %s: %v", name, err))
+		return fallback
+	}
+	return b
+}
+
+func (l *loader) list(name string) []string {
+	value, _ := l.lookup(name)
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (l *loader) totpAlgorithm(name string) otp.Algorithm {
+	value, _ := l.lookup(name)
+
+	switch strings.ToUpper(value) {
+	case "", "SHA1":
+		return otp.AlgorithmSHA1
+	case "SHA256":
+		return otp.AlgorithmSHA256
+	case "SHA512":
+		return otp.AlgorithmSHA512
+	}
+
+	l.errors = append(l.errors, fmt.Sprintf("invalid %s: expected SHA1, SHA256 or SHA512", name))
+	return otp.AlgorithmSHA1
+}
+
+// encryption reads "version:base64 key" pairs, using the highest version unless one is chosen explicitly
+func (l *loader) encryption(keysName, versionName string) Encryption {
+	encryption := Encryption{Keys: map[int][]byte{}}
+
+	for id, encoded := range l.credentials(keysName) {
+		version, err := strconv.Atoi(id)
+		if err != nil || version < 1 {
+			l.errors = append(l.errors, fmt.Sprintf("invalid %s: versions must be positive numbers", keysName))
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			l.errors = append(l.errors, fmt.Sprintf("invalid %s: version %d is not a base64 encoded 32 byte key", keysName, version))
+			continue
+		}
+
+		encryption.Keys[version] = key
+		if version > encryption.ActiveVersion {
+			encryption.ActiveVersion = version
+		}
+	}
+
+	if _, ok := l.lookup(versionName); ok {
+		encryption.ActiveVersion = l.int(versionName, encryption.ActiveVersion)
+	}
+
+	return encryption
+}
+
+// credentials reads a list of "id:secret" pairs
+func (l *loader) credentials(name string) map[string]string {
+	credentials := map[string]string{}
+	for _, item := range l.list(name) {
+		id, secret, ok := strings.Cut(item, ":")
+		if !ok || id == "" || secret == "" {
+			l.errors = append(l.errors, fmt.Sprintf("invalid %s: expected id:secret pairs", name))
+			continue
+		}
+		credentials[id] = secret
+	}
+	return credentials
+}
@@ -1,26 +1,41 @@
 package controllers
 
 import (
-	"encoding/base64"
 	"encoding/base32"
+	"errors"
 
 	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
-	"time"
-	// "github.com/pquerna/otp"
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"github.com/skip2/go-qrcode"
+	"go-auth/config"
 	"go-auth/db"
+	"go-auth/middleware"
 	"go-auth/models"
 	"go-auth/utils"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Shown as the account's provider in authenticator apps
+const totpIssuer = "Go Auth"
+
+// Second factors a login can be finished with
+const (
+	methodTOTP     = "totp"
+	methodEmail    = "email"
+	methodWebAuthn = "webauthn"
 )
 
 type TwoFactorRequest struct {
-	ID         string `json:"id"`
-	Code       string `json:"code"`
-	Secret     string `json:"secret"`
-	RememberMe bool   `json:"rememberMe"`
+	ChallengeToken string `json:"challenge_token" validate:"required"`
+	Code           string `json:"code" validate:"required_without=RecoveryCode"`
+	Method         string `json:"method" validate:"omitempty,oneof=totp email"` // Whether Code is a "totp" or "email" code, the user's preference by default
+	RecoveryCode   string `json:"recovery_code"`                                // Used instead of Code when the authenticator is lost
+	RememberMe     bool   `json:"rememberMe"`
+	TrustDevice    bool   `json:"trust_device"` // Skip the second factor on this browser's next logins
 }
 
 func TwoFactor(c *fiber.Ctx) error {
@@ -29,111 +44,446 @@ func TwoFactor(c *fiber.Ctx) error {
 		fmt.Println(err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
 	}
+	if fieldErrors := utils.Validate(req); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
 
-	// Validate UUID
-	if _, err := uuid.Parse(req.ID); err != nil {
+	// The challenge proves the password was checked, and limits how many codes can be tried
+	challenge, err := attemptChallenge(c, req.ChallengeToken)
+	if err != nil {
 		fmt.Println(err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credentials"})
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Invalid or expired challenge"})
 	}
 
 	// Find user
 	var user models.User
-	if err := db.DB.Where("id = ?", req.ID).First(&user).Error; err != nil {
+	if err := db.DB.Where("id = ?", challenge.UserID).First(&user).Error; err != nil {
 		fmt.Println(err)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credentials"})
 	}
 
-	// Get secret
-	secret := user.TFASecret
-	if secret == "" {
-		secret = req.Secret
+	// The magic link came from the same mailbox, so an email code would not be a second factor
+	method := req.Method
+	if challenge.MagicLink {
+		if method == methodEmail {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Email codes cannot finish a magic link login"})
+		}
+		method = methodTOTP
 	}
 
-	// Verify code
-	valid := totp.Validate(req.Code, secret)
-	if !valid {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credentials"})
+	// Verify code, or a recovery code in its place
+	if err := verifySecondFactor(c, user, method, req.Code, req.RecoveryCode, &challenge.ID); err != nil {
+		return twoFactorError(c, err)
 	}
 
-	// Save secret if new
-	if user.TFASecret == "" {
-		if err := db.DB.Model(&user).Update("tfa_secret", secret).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error saving secret"})
+	// The challenge can only be completed once
+	if err := completeChallenge(challenge); err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Invalid or expired challenge"})
+	}
+
+	if req.TrustDevice {
+		if err := trustDevice(c, user.Id); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error trusting device"})
 		}
 	}
 
 	// Generate tokens
-	userID, _ := uuid.Parse(req.ID)
-	accessToken, err := utils.GenerateAccessToken(userID)
+	accessToken, err := startSession(c, user.Id, req.RememberMe || challenge.RememberMe)
 	if err != nil {
 		fmt.Println(err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
 	}
 
-	refreshToken, err := utils.GenerateRefreshToken(userID)
+	// Warn the user when they are running out of recovery codes
+	if req.RecoveryCode != "" {
+		remaining, _ := remainingRecoveryCodes(user.Id)
+		return c.JSON(fiber.Map{"token": accessToken, "recovery_codes_remaining": remaining})
+	}
+
+	return c.JSON(fiber.Map{"token": accessToken})
+}
+
+// issueChallenge records a pending second factor for the user and returns it with the signed token that identifies it
+func issueChallenge(c *fiber.Ctx, userID uuid.UUID, rememberMe, magicLink bool) (models.MFAChallenge, string, error) {
+	cfg := config.Get(c)
+
+	challenge := models.MFAChallenge{
+		UserID:     userID,
+		RememberMe: rememberMe,
+		MagicLink:  magicLink,
+		ExpiresAt:  time.Now().Add(cfg.MFAChallengeTTL),
+	}
+	if err := db.DB.Create(&challenge).Error; err != nil {
+		return challenge, "", err
+	}
+
+	token, err := utils.GeneratePurposeToken(cfg.JWT, utils.PurposeMFAChallenge, userID, challenge.ID, cfg.MFAChallengeTTL)
+
+	return challenge, token, err
+}
+
+// findChallenge verifies a challenge token without counting an attempt, for steps that do not check a code
+func findChallenge(c *fiber.Ctx, token string) (models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+
+	claims, err := utils.ParsePurposeToken(config.Get(c).JWT, utils.PurposeMFAChallenge, token)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
+		return challenge, err
 	}
 
-	// Set expiration based on rememberMe
-	var expiration time.Time
-	if req.RememberMe {
-		expiration = time.Now().Add(365 * 24 * time.Hour) // 1 year
-	} else {
-		expiration = time.Now().Add(30 * time.Second) // 30 seconds
+	userID, err := claims.UserID()
+	if err != nil {
+		return challenge, err
 	}
 
-	// Save refresh token
-	refreshTokenRecord := models.Token{
-		User_id:   userID,
-		Token:     refreshToken,
-		ExpiredAt: expiration,
+	err = db.DB.Where("id = ? AND user_id = ? AND used = ? AND expires_at >= ? AND attempts < ?",
+		claims.ID, userID, false, time.Now(), config.Get(c).MFAMaxAttempts).
+		First(&challenge).Error
+
+	return challenge, err
+}
+
+// twoFactorMethods lists the second factors the user can finish a login with, the preferred one first.
+// It is empty when 2FA is off.
+func twoFactorMethods(user models.User) ([]string, error) {
+	methods := []string{}
+	if user.TFASecret != "" {
+		methods = append(methods, methodTOTP)
+	}
+	if user.TFAEmailEnabled {
+		methods = append(methods, methodEmail)
 	}
 
-	if err := db.DB.Create(&refreshTokenRecord).Error; err != nil {
-		fmt.Println(err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error saving token"})
+	var keys int64
+	if err := db.DB.Model(&models.WebAuthnCredential{}).Where("user_id = ?", user.Id).Count(&keys).Error; err != nil {
+		return nil, err
+	}
+	if keys > 0 {
+		methods = append(methods, methodWebAuthn)
 	}
 
-	// Set cookie
-	c.Cookie(&fiber.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		Expires:  expiration,
-		HTTPOnly: true,
-		Secure:   true,
-	})
+	for i, method := range methods {
+		if method == user.TFAMethod {
+			methods[0], methods[i] = methods[i], methods[0]
+		}
+	}
 
-	return c.JSON(fiber.Map{"token": accessToken})
+	return methods, nil
+}
+
+func withoutMethod(methods []string, excluded string) []string {
+	kept := []string{}
+	for _, method := range methods {
+		if method != excluded {
+			kept = append(kept, method)
+		}
+	}
+	return kept
 }
 
-// !! Fix this issue, it return the same secret key on 2fas auth app
-func QR(c *fiber.Ctx) error {
-	// Decode the base32 secret correctly 
-	secretStr := "YRBGFHTE7J53MIVWE64S4HFRU2IPZ5PY"
-	decodedSecret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secretStr)
+// codeMethod decides which kind of code the TwoFactor step checks when the client does not say
+func codeMethod(user models.User, requested string) string {
+	if requested != "" {
+		return requested
+	}
+	if user.TFAMethod == methodEmail || (user.TFASecret == "" && user.TFAEmailEnabled) {
+		return methodEmail
+	}
+	return methodTOTP
+}
+
+// attemptChallenge verifies a challenge token and counts one attempt against it
+func attemptChallenge(c *fiber.Ctx, token string) (models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+
+	claims, err := utils.ParsePurposeToken(config.Get(c).JWT, utils.PurposeMFAChallenge, token)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error decoding secret")
+		return challenge, err
 	}
 
+	userID, err := claims.UserID()
+	if err != nil {
+		return challenge, err
+	}
+
+	// Count the attempt up front, so parallel requests cannot go over the limit
+	result := db.DB.Model(&models.MFAChallenge{}).
+		Where("id = ? AND user_id = ? AND used = ? AND expires_at >= ? AND attempts < ?",
+			claims.ID, userID, false, time.Now(), config.Get(c).MFAMaxAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return challenge, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return challenge, fmt.Errorf("challenge is used, expired or out of attempts")
+	}
+
+	err = db.DB.First(&challenge, "id = ?", claims.ID).Error
+
+	return challenge, err
+}
+
+// completeChallenge marks the challenge as used, failing if another request already did
+func completeChallenge(challenge models.MFAChallenge) error {
+	result := db.DB.Model(&models.MFAChallenge{}).
+		Where("id = ? AND used = ?", challenge.ID, false).
+		Update("used", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("challenge was already used")
+	}
+
+	return nil
+}
+
+func EnrollTwoFactor(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+	if user.TFASecret != "" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": "Two-factor authentication is already enabled"})
+	}
+
+	return enrollTOTP(c, user)
+}
+
+// enrollTOTP generates a new secret, kept pending until the user proves their app has it
+func enrollTOTP(c *fiber.Ctx, user models.User) error {
+	cfg := config.Get(c).TOTP
 	key, err := totp.Generate(totp.GenerateOpts{
-		Issuer:      "Go Auth",
-		AccountName: "test2@mail.com",
-		Secret:      decodedSecret, // Use decoded bytes
-		SecretSize:  uint(len(decodedSecret) * 8), // Calculate proper size
+		Issuer:      totpIssuer,
+		AccountName: user.Email,
+		SecretSize:  20,
+		Period:      cfg.Period,
+		Digits:      cfg.Digits,
+		Algorithm:   cfg.Algorithm,
 	})
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error generating QR code")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating 2FA secret"})
+	}
+
+	encryptedSecret, err := utils.EncryptSecret(config.Get(c).Encryption, key.Secret(), user.Id.String())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error saving secret"})
+	}
+
+	if err := db.DB.Model(&user).Update("tfa_pending_secret", encryptedSecret).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error saving secret"})
+	}
+
+	return c.JSON(fiber.Map{
+		"secret":      key.Secret(),
+		"otpauth_url": key.URL(),
+	})
+}
+
+func TwoFactorQR(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+	if user.TFAPendingSecret == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "No two-factor enrollment in progress"})
+	}
+
+	secret, err := utils.DecryptSecret(config.Get(c).Encryption, user.TFAPendingSecret, user.Id.String())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating QR code"})
+	}
+
+	key, err := totpKey(config.Get(c).TOTP, user.Email, secret)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating QR code"})
+	}
+
+	// The QR code holds the secret, so it must never be cached
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	if c.Query("format") == "svg" {
+		svg, err := utils.QRCodeSVG(key.URL())
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating QR code"})
+		}
+
+		c.Set(fiber.HeaderContentType, "image/svg+xml")
+		return c.SendString(svg)
 	}
 
-	// Generate QR code
 	png, err := qrcode.Encode(key.URL(), qrcode.Medium, 256)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error generating QR code")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating QR code"})
+	}
+
+	c.Set(fiber.HeaderContentType, "image/png")
+	return c.Send(png)
+}
+
+func ConfirmTwoFactor(c *fiber.Ctx) error {
+	type ConfirmInput struct {
+		Code string `json:"code" validate:"required,numeric"`
+	}
+
+	var input ConfirmInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
+	}
+	if fieldErrors := utils.Validate(input); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
+
+	user := middleware.CurrentUser(c)
+	if user.TFAPendingSecret == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "No two-factor enrollment in progress"})
+	}
+
+	if err := verifyTOTP(c, user, user.TFAPendingSecret, input.Code, 0); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	methods, err := twoFactorMethods(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading two-factor methods"})
+	}
+
+	// Activate the pending secret, which is already encrypted
+	if err := db.DB.Model(&user).Updates(map[string]interface{}{
+		"tfa_secret":         user.TFAPendingSecret,
+		"tfa_pending_secret": "",
+	}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error saving secret"})
+	}
+
+	// Replacing the authenticator app starts over with new recovery codes, otherwise the user
+	// only gets them with their first second factor
+	var codes []string
+	if user.TFASecret != "" {
+		codes, err = replaceRecoveryCodes(c, user.Id)
+	} else {
+		codes, err = recoveryCodesForNewFactor(c, user.Id, methods)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating recovery codes"})
+	}
+
+	response := fiber.Map{"message": "Two-factor authentication enabled"}
+	if codes != nil {
+		response["recovery_codes"] = codes
+	}
+
+	// Moving to a new authenticator logs out everywhere else
+	if user.TFASecret != "" {
+		accessToken, err := revokeSessionsAfterFactorChange(c, user.Id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error revoking sessions"})
+		}
+		response["token"] = accessToken
+	}
+
+	return c.JSON(response)
+}
+
+// totpKey rebuilds the otpauth key of a stored base32 secret
+func totpKey(cfg config.TOTP, email, secret string) (*otp.Key, error) {
+	decodedSecret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: email,
+		Secret:      decodedSecret,
+		Period:      cfg.Period,
+		Digits:      cfg.Digits,
+		Algorithm:   cfg.Algorithm,
+	})
+}
+
+var (
+	errInvalidCode     = errors.New("invalid code")
+	errTwoFactorLocked = errors.New("too many failed two-factor attempts")
+)
+
+// verifySecondFactor checks a code of the requested kind, or a recovery code in its place, which also
+// works for users with only security keys. Email codes must have been sent for challengeID.
+func verifySecondFactor(c *fiber.Ctx, user models.User, method, code, recoveryCode string, challengeID *uuid.UUID) error {
+	method = codeMethod(user, method)
+
+	switch {
+	case recoveryCode != "":
+		return verifyRecoveryCode(c, user, recoveryCode)
+	case method == methodEmail && user.TFAEmailEnabled:
+		return verifyEmailCode(c, user, challengeID, code)
+	case method == methodTOTP && user.TFASecret != "":
+		return verifyTOTP(c, user, user.TFASecret, code, user.TFALastStep)
+	}
+
+	return errInvalidCode
+}
+
+// verifyTOTP checks a code against the stored (encrypted) secret, rejecting codes from a time step
+// up to lastStep and locking the second factor after too many failures in a row. A pending secret
+// has no codes used yet, so it is checked with a lastStep of 0.
+func verifyTOTP(c *fiber.Ctx, user models.User, storedSecret, code string, lastStep int64) error {
+	if twoFactorLocked(user) {
+		return errTwoFactorLocked
+	}
+
+	secret, err := utils.DecryptSecret(config.Get(c).Encryption, storedSecret, user.Id.String())
+	if err != nil {
+		return err
 	}
 
-	// Convert to base64
-	encoded := base64.StdEncoding.EncodeToString(png)
-	return c.SendString(fmt.Sprintf("<img src=\"data:image/png;base64,%s\" />", encoded))
-}
\ No newline at end of file
+	if step, ok := utils.ValidateTOTP(config.Get(c).TOTP, secret, code, lastStep); ok {
+		// Record the step, unless a parallel request with the same code got there first
+		result := db.DB.Model(&models.User{}).
+			Where("id = ? AND tfa_last_step = ?", user.Id, user.TFALastStep).
+			Updates(map[string]interface{}{"tfa_last_step": step, "tfa_failed_attempts": 0})
+		if result.Error == nil && result.RowsAffected == 1 {
+			return nil
+		}
+	}
+
+	recordTwoFactorFailure(c, user)
+	return errInvalidCode
+}
+
+// verifyRecoveryCode consumes a recovery code, counting failures like verifyTOTP
+func verifyRecoveryCode(c *fiber.Ctx, user models.User, code string) error {
+	if twoFactorLocked(user) {
+		return errTwoFactorLocked
+	}
+
+	if !useRecoveryCode(user.Id, code) {
+		recordTwoFactorFailure(c, user)
+		return errInvalidCode
+	}
+
+	return db.DB.Model(&models.User{}).Where("id = ?", user.Id).Update("tfa_failed_attempts", 0).Error
+}
+
+func twoFactorLocked(user models.User) bool {
+	return user.TFALockedUntil != nil && user.TFALockedUntil.After(time.Now())
+}
+
+func recordTwoFactorFailure(c *fiber.Ctx, user models.User) {
+	cfg := config.Get(c).TOTP
+
+	db.DB.Model(&models.User{}).Where("id = ?", user.Id).
+		Update("tfa_failed_attempts", gorm.Expr("tfa_failed_attempts + 1"))
+
+	// Lock once the limit is reached, starting the count over for when the lock runs out
+	db.DB.Model(&models.User{}).Where("id = ? AND tfa_failed_attempts >= ?", user.Id, cfg.MaxFailures).
+		Updates(map[string]interface{}{
+			"tfa_failed_attempts": 0,
+			"tfa_locked_until":    time.Now().Add(cfg.Lockout),
+		})
+}
+
+func twoFactorError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errTwoFactorLocked) {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": "Too many failed attempts, try again later"})
+	}
+	if errors.Is(err, errInvalidCode) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credentials"})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error verifying code"})
+}
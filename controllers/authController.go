@@ -1,57 +1,76 @@
 package controllers
 
 import (
+	"go-auth/config"
 	"go-auth/db"
+	"go-auth/middleware"
 	"go-auth/models"
 
 	"fmt"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"github.com/pquerna/otp/totp"
 	"go-auth/utils"
-	"os"
-	"strings"
 	"time"
 )
 
 func Register(c *fiber.Ctx) error {
-	var data map[string]string
+	type RegisterInput struct {
+		FirstName       string `json:"first_name" validate:"required,max=100"`
+		LastName        string `json:"last_name" validate:"max=100"`
+		Email           string `json:"email" validate:"required,email,max=255"`
+		Password        string `json:"password" validate:"required"` // The rest is up to the password policy
+		PasswordConfirm string `json:"password_confirm" validate:"required,eqfield=Password"`
+	}
 
+	var data RegisterInput
 	// Parse JSON body
 	if err := c.BodyParser(&data); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
-	// Validate password confirmation
-	if data["password"] != data["password_confirm"] {
-		c.Status(400)
-		return c.JSON(fiber.Map{
-			"message": "Passwords do not match!",
-		})
+	if fieldErrors := utils.Validate(data); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
+	if problems := utils.CheckPassword(config.Get(c).Password, data.Password, data.Email, data.FirstName, data.LastName); problems != nil {
+		return validationFailed(c, problems)
+	}
+
+	var existing int64
+	if err := db.DB.Model(&models.User{}).Where("email = ?", data.Email).Count(&existing).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error creating user"})
+	}
+	if existing > 0 {
+		return validationFailed(c, []utils.FieldError{{Field: "email", Rule: "unique", Message: "email is already registered"}})
 	}
 
 	// Hash password using utils.HashPassword
-	hashedPassword := utils.HashPassword(data["password"])
+	hashedPassword := utils.HashPassword(config.Get(c).Argon2, data.Password)
 
 	// Save user to database
 	user := &models.User{
-		FirstName: data["first_name"],
-		LastName:  data["last_name"],
-		Email:     data["email"],
+		FirstName: data.FirstName,
+		LastName:  data.LastName,
+		Email:     data.Email,
 		Password:  []byte(hashedPassword),
 	}
 
-	db.DB.Create(user)
+	if err := db.DB.Create(user).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error creating user"})
+	}
+
+	// The account exists either way, a failed email can be sent again through the resend endpoint
+	if err := sendVerificationEmail(config.Get(c), *user); err != nil {
+		fmt.Println("Failed to send verification email:", err)
+	}
 
 	return c.JSON(user)
 }
 
 func Login(c *fiber.Ctx) error {
 	type LoginInput struct {
-		Email      string `json:"email"`
-		Password   string `json:"password"`
+		Email      string `json:"email" validate:"required,email"`
+		Password   string `json:"password" validate:"required"`
 		RememberMe bool   `json:"rememberMe"`
 	}
 
@@ -63,6 +82,9 @@ func Login(c *fiber.Ctx) error {
 			"error": "Invalid request body",
 		})
 	}
+	if fieldErrors := utils.Validate(data); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
 
 	var user models.User
 
@@ -79,179 +101,273 @@ func Login(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if 2FA is already set up
-	if user.TFASecret != "" {
-		return c.JSON(fiber.Map{
-			"id":         user.Id.String(),
-			"rememberMe": data.RememberMe, // Tetap bool, bukan string
-		})
+	// Upgrade imported bcrypt and scrypt hashes, and ones made with weaker parameters, while the plaintext is at hand
+	if cfg := config.Get(c).Argon2; utils.PasswordNeedsRehash(cfg, string(user.Password)) {
+		rehashPassword(cfg, user, data.Password)
 	}
 
-	// Generate new 2FA secret if not exists
-	key, err := totp.Generate(totp.GenerateOpts{
-		Issuer:      "Go Auth",
-		AccountName: user.Email,
-		SecretSize:  20,
-	})
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"message": "Error generating 2FA secret",
+	if unverifiedEmailBlocksLogin(c, user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"message": "Email address is not verified",
 		})
 	}
 
-	// Generate tokens
-	accessToken, err := utils.GenerateAccessToken(user.Id)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
+	return completeLogin(c, user, data.RememberMe, false)
+}
+
+// rehashPassword stores a new hash of the password, unless it was changed since the user was loaded
+func rehashPassword(cfg config.Argon2, user models.User, password string) {
+	if err := db.DB.Model(&models.User{}).
+		Where("id = ? AND password = ?", user.Id, user.Password).
+		Update("password", utils.HashPassword(cfg, password)).Error; err != nil {
+		fmt.Println("Failed to rehash password:", err)
 	}
+}
 
-	refreshToken, err := utils.GenerateRefreshToken(user.Id)
+// completeLogin starts a session for a user whose first factor was verified, or, when 2FA is set up,
+// responds with the challenge token the client has to finish the login with. After a magic link the
+// mailbox was the first factor, so email codes are not offered as the second one.
+func completeLogin(c *fiber.Ctx, user models.User, rememberMe, magicLink bool) error {
+	methods, err := twoFactorMethods(user)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
 	}
 
-	// Save refresh token
-	expiredAt := time.Now().Add(7 * 24 * time.Hour)
-	refreshTokenRecord := models.Token{
-		User_id:   user.Id,
-		Token:     refreshToken,
-		ExpiredAt: expiredAt,
-	}
+	// A browser trusted after an earlier second factor skips it
+	if len(methods) > 0 && !useTrustedDevice(c, user.Id) {
+		if magicLink {
+			methods = withoutMethod(methods, methodEmail)
+			if len(methods) == 0 {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": "Please log in with your password"})
+			}
+		}
 
-	if err := db.DB.Create(&refreshTokenRecord).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error saving token"})
+		challenge, challengeToken, err := issueChallenge(c, user.Id, rememberMe, magicLink)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
+		}
+
+		// Users who prefer email codes get one right away, the client can ask for another one later
+		if methods[0] == methodEmail {
+			if err := sendEmailCode(c, user, &challenge.ID); err != nil {
+				fmt.Println("Failed to send email:", err)
+			}
+		}
+
+		return c.JSON(fiber.Map{
+			"challenge_token": challengeToken,
+			"methods":         methods,
+			"rememberMe":      rememberMe, // Tetap bool, bukan string
+		})
 	}
 
-	// Set cookie
-	c.Cookie(&fiber.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		Expires:  expiredAt,
-		HTTPOnly: true,
-		Secure:   true,
-	})
+	accessToken, err := startSession(c, user.Id, rememberMe)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
+	}
 
 	return c.JSON(fiber.Map{
-		"token":       accessToken,
-		"rememberMe":  data.RememberMe, // Tetap bool, bukan string
-		"secret":      key.Secret(),
-		"otpauth_url": key.URL(),
+		"token":      accessToken,
+		"rememberMe": rememberMe, // Tetap bool, bukan string
 	})
 }
 
 func AuthenticatedUser(c *fiber.Ctx) error {
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
-	}
+	user := middleware.CurrentUser(c)
 
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	if tokenString == "" {
+	// Remove password from response
+	user.Password = nil
+	return c.JSON(user)
+}
+
+func Refresh(c *fiber.Ctx) error {
+	refreshToken, err := findRefreshToken(c)
+	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
 	}
+	userID := refreshToken.User_id
 
-	// Verify token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv("JWT_SECRET_ACCESS")), nil
-	})
+	// A rotated token being presented again means it was copied, so revoke the whole family
+	if refreshToken.Used {
+		return revokeTokenFamily(c, refreshToken)
+	}
 
-	if err != nil || !token.Valid {
+	if refreshToken.ExpiredAt.Before(time.Now()) {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+	// Mark the old token as used, guarding against two concurrent refreshes with the same token
+	result := db.DB.Model(&models.Token{}).
+		Where("id = ? AND used = ?", refreshToken.Id, false).
+		Update("used", true)
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error rotating token"})
+	}
+	if result.RowsAffected == 0 {
+		return revokeTokenFamily(c, refreshToken)
 	}
 
-	// Convert the UUID string from claims to uuid.UUID
-	userIDString, ok := claims["id"].(string)
-	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+	// Generate new tokens, the refresh token only lives as long as what is left of the session
+	cfg := config.Get(c)
+	accessToken, err := utils.GenerateAccessToken(cfg.JWT, userID, refreshToken.Family, cfg.AccessTokenTTL)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
 	}
 
-	userID, err := uuid.Parse(userIDString)
+	newRefreshToken, err := utils.GenerateRefreshToken(cfg.JWT, userID, time.Until(refreshToken.ExpiredAt))
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
 	}
 
-	var user models.User
-	if err := db.DB.First(&user, userID).Error; err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+	// Save rotated refresh token in the same family, keeping the original expiry and login time
+	refreshTokenRecord := models.Token{
+		User_id:    userID,
+		Family:     refreshToken.Family,
+		Token:      newRefreshToken,
+		ExpiredAt:  refreshToken.ExpiredAt,
+		RememberMe: refreshToken.RememberMe,
+		CreatedAt:  refreshToken.CreatedAt,
 	}
 
-	// Remove password from response
-	user.Password = nil
-	return c.JSON(user)
+	if err := saveRefreshToken(c, refreshTokenRecord); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error saving token"})
+	}
+
+	return c.JSON(fiber.Map{"token": accessToken})
 }
 
-func Refresh(c *fiber.Ctx) error {
-	cookie := c.Cookies("refresh_token")
-	if cookie == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
-	}
+// startSession creates a new refresh token family for the user, sets its cookie and returns an access token for it
+func startSession(c *fiber.Ctx, userID uuid.UUID, rememberMe bool) (string, error) {
+	// Generate tokens, with the session lifetime based on rememberMe
+	cfg := config.Get(c)
+	sessionTTL := cfg.SessionTTL(rememberMe)
+	family := uuid.New()
 
-	// Verify refresh token
-	token, err := jwt.Parse(cookie, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv("JWT_SECRET_REFRESH")), nil
-	})
+	accessToken, err := utils.GenerateAccessToken(cfg.JWT, userID, family, cfg.AccessTokenTTL)
+	if err != nil {
+		return "", err
+	}
 
-	if err != nil || !token.Valid {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+	refreshToken, err := utils.GenerateRefreshToken(cfg.JWT, userID, sessionTTL)
+	if err != nil {
+		return "", err
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+	// Save refresh token
+	refreshTokenRecord := models.Token{
+		User_id:    userID,
+		Family:     family,
+		Token:      refreshToken,
+		ExpiredAt:  time.Now().Add(sessionTTL),
+		RememberMe: rememberMe,
 	}
 
-	// Convert the UUID string from claims to uuid.UUID
-	userIDString, ok := claims["id"].(string)
-	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+	if err := saveRefreshToken(c, refreshTokenRecord); err != nil {
+		return "", err
 	}
 
-	userID, err := uuid.Parse(userIDString)
-	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+	return accessToken, nil
+}
+
+// saveRefreshToken stores the token with the current request's client details and sets the cookie
+func saveRefreshToken(c *fiber.Ctx, record models.Token) error {
+	record.UserAgent = c.Get(fiber.HeaderUserAgent)
+	record.IP = c.IP()
+	record.LastUsedAt = time.Now()
+
+	if err := db.DB.Create(&record).Error; err != nil {
+		return err
 	}
 
-	// Check if refresh token exists in DB
+	// Set cookie
+	c.Cookie(&fiber.Cookie{
+		Name:     "refresh_token",
+		Value:    record.Token,
+		Expires:  record.ExpiredAt,
+		HTTPOnly: true,
+		Secure:   true,
+	})
+
+	return nil
+}
+
+// findRefreshToken verifies the refresh_token cookie and loads its row, including used ones
+func findRefreshToken(c *fiber.Ctx) (models.Token, error) {
 	var refreshToken models.Token
-	err = db.DB.Where("user_id = ? AND token = ? AND expired_at >= ?",
-		userID,
-		cookie,
-		time.Now(),
-	).First(&refreshToken).Error
 
+	cookie := c.Cookies("refresh_token")
+	if cookie == "" {
+		return refreshToken, fmt.Errorf("missing refresh token")
+	}
+
+	// Verify refresh token
+	claims, err := utils.ParseRefreshToken(config.Get(c).JWT, cookie)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+		return refreshToken, err
 	}
 
-	// Generate new access token
-	accessToken, err := utils.GenerateAccessToken(userID)
+	userID, err := claims.UserID()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
+		return refreshToken, err
 	}
 
-	return c.JSON(fiber.Map{"token": accessToken})
+	// Check if refresh token exists in DB
+	err = db.DB.Where("user_id = ? AND token = ?", userID, cookie).First(&refreshToken).Error
+
+	return refreshToken, err
 }
 
-func Logout(c *fiber.Ctx) error {
-	cookie := fiber.Cookie{
+// revokeTokenFamily deletes every refresh token issued from the same login and clears the cookie
+func revokeTokenFamily(c *fiber.Ctx, token models.Token) error {
+	if err := deleteTokenFamily(token); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error revoking token"})
+	}
+
+	clearRefreshCookie(c)
+
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+}
+
+func deleteTokenFamily(token models.Token) error {
+	return db.DB.Where("user_id = ? AND family = ?", token.User_id, token.Family).Delete(&models.Token{}).Error
+}
+
+func clearRefreshCookie(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
 		Name:     "refresh_token",
 		Value:    "",
 		Expires:  time.Now().Add(-time.Hour),
 		HTTPOnly: true,
+	})
+}
+
+func Logout(c *fiber.Ctx) error {
+	// Revoke the session behind the cookie so a copied refresh token stops working too
+	if refreshToken, err := findRefreshToken(c); err == nil {
+		if err := deleteTokenFamily(refreshToken); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error revoking token"})
+		}
+	}
+
+	clearRefreshCookie(c)
+
+	return c.JSON(fiber.Map{
+		"message": "success",
+	})
+}
+
+func LogoutAll(c *fiber.Ctx) error {
+	refreshToken, err := findRefreshToken(c)
+	if err != nil || refreshToken.Used || refreshToken.ExpiredAt.Before(time.Now()) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+	}
+
+	// Revoke every refresh token the user holds, on every device
+	if err := db.DB.Where("user_id = ?", refreshToken.User_id).Delete(&models.Token{}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error revoking tokens"})
 	}
 
-	c.Cookie(&cookie)
+	clearRefreshCookie(c)
 
 	return c.JSON(fiber.Map{
 		"message": "success",
@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"go-auth/config"
+	"go-auth/db"
+	"go-auth/middleware"
+	"go-auth/models"
+	"go-auth/utils"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var errResendTooSoon = errors.New("a code was sent too recently")
+
+// SendTwoFactorEmail emails a new code for the login behind the challenge token
+func SendTwoFactorEmail(c *fiber.Ctx) error {
+	type SendInput struct {
+		ChallengeToken string `json:"challenge_token" validate:"required"`
+	}
+
+	var input SendInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
+	}
+	if fieldErrors := utils.Validate(input); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
+
+	challenge, err := findChallenge(c, input.ChallengeToken)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Invalid or expired challenge"})
+	}
+	if challenge.MagicLink {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Email codes cannot finish a magic link login"})
+	}
+
+	var user models.User
+	if err := db.DB.Where("id = ?", challenge.UserID).First(&user).Error; err != nil || !user.TFAEmailEnabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Email codes are not enabled"})
+	}
+
+	if err := sendEmailCode(c, user, &challenge.ID); err != nil {
+		return emailCodeError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Please check your email"})
+}
+
+// EnrollEmailTwoFactor sends a code that has to be confirmed before email codes are enabled
+func EnrollEmailTwoFactor(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+	if user.TFAEmailEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": "Email codes are already enabled"})
+	}
+
+	if err := sendEmailCode(c, user, nil); err != nil {
+		return emailCodeError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Please check your email"})
+}
+
+func ConfirmEmailTwoFactor(c *fiber.Ctx) error {
+	type ConfirmInput struct {
+		Code string `json:"code" validate:"required,numeric"`
+	}
+
+	var input ConfirmInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
+	}
+	if fieldErrors := utils.Validate(input); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
+
+	user := middleware.CurrentUser(c)
+	if user.TFAEmailEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": "Email codes are already enabled"})
+	}
+
+	if err := verifyEmailCode(c, user, nil, input.Code); err != nil {
+		return twoFactorError(c, err)
+	}
+
+	methods, err := twoFactorMethods(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error enabling email codes"})
+	}
+
+	if err := db.DB.Model(&user).Update("tfa_email_enabled", true).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error enabling email codes"})
+	}
+
+	response := fiber.Map{"message": "Email codes enabled"}
+
+	codes, err := recoveryCodesForNewFactor(c, user.Id, methods)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating recovery codes"})
+	}
+	if codes != nil {
+		response["recovery_codes"] = codes
+	}
+
+	return c.JSON(response)
+}
+
+// SetTwoFactorMethod chooses which of the enabled second factors is offered first at login
+func SetTwoFactorMethod(c *fiber.Ctx) error {
+	type MethodInput struct {
+		Method string `json:"method" validate:"required,oneof=totp email webauthn"`
+	}
+
+	var input MethodInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
+	}
+	if fieldErrors := utils.Validate(input); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
+
+	user := middleware.CurrentUser(c)
+
+	methods, err := twoFactorMethods(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading two-factor methods"})
+	}
+
+	enabled := false
+	for _, method := range methods {
+		enabled = enabled || method == input.Method
+	}
+	if !enabled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Two-factor method is not enabled"})
+	}
+
+	if err := db.DB.Model(&user).Update("tfa_method", input.Method).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error saving two-factor method"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "success",
+	})
+}
+
+// sendEmailCode replaces the user's pending email code with a new one and sends it,
+// unless the previous code was sent less than the resend interval ago
+func sendEmailCode(c *fiber.Ctx, user models.User, challengeID *uuid.UUID) error {
+	cfg := config.Get(c)
+
+	var recent int64
+	if err := db.DB.Model(&models.EmailOTP{}).
+		Where("user_id = ? AND created_at > ?", user.Id, time.Now().Add(-cfg.EmailOTP.ResendInterval)).
+		Count(&recent).Error; err != nil {
+		return err
+	}
+	if recent > 0 {
+		return errResendTooSoon
+	}
+
+	code, err := utils.GenerateNumericCode(cfg.EmailOTP.Digits)
+	if err != nil {
+		return err
+	}
+
+	record := models.EmailOTP{
+		UserID:      user.Id,
+		ChallengeID: challengeID,
+		CodeHash:    utils.HashPassword(cfg.Argon2, code),
+		ExpiresAt:   time.Now().Add(cfg.EmailOTP.TTL),
+	}
+
+	// Only the latest code is valid
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.EmailOTP{}).
+			Where("user_id = ? AND used = ?", user.Id, false).
+			Update("used", true).Error; err != nil {
+			return err
+		}
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return utils.SendMail(cfg.SMTP, user.Email, "Your verification code", "templates/two_factor_code.html", struct {
+		Email   string
+		Code    string
+		Minutes int
+	}{
+		Email:   user.Email,
+		Code:    code,
+		Minutes: int(math.Ceil(cfg.EmailOTP.TTL.Minutes())),
+	})
+}
+
+// verifyEmailCode consumes the code sent for the challenge, or for enrollment when challengeID is nil,
+// counting failures towards the same lockout as TOTP codes
+func verifyEmailCode(c *fiber.Ctx, user models.User, challengeID *uuid.UUID, code string) error {
+	if twoFactorLocked(user) {
+		return errTwoFactorLocked
+	}
+
+	query := db.DB.Where("user_id = ? AND used = ? AND expires_at >= ?", user.Id, false, time.Now())
+	if challengeID != nil {
+		query = query.Where("challenge_id = ?", *challengeID)
+	} else {
+		query = query.Where("challenge_id IS NULL")
+	}
+
+	var record models.EmailOTP
+	code = strings.TrimSpace(code)
+	if code != "" && query.First(&record).Error == nil && utils.VerifyPassword(record.CodeHash, code) {
+		// Only one request may consume the code
+		result := db.DB.Model(&models.EmailOTP{}).
+			Where("id = ? AND used = ?", record.ID, false).
+			Update("used", true)
+		if result.Error == nil && result.RowsAffected == 1 {
+			return db.DB.Model(&models.User{}).Where("id = ?", user.Id).Update("tfa_failed_attempts", 0).Error
+		}
+	}
+
+	recordTwoFactorFailure(c, user)
+	return errInvalidCode
+}
+
+func emailCodeError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errResendTooSoon) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(config.Get(c).EmailOTP.ResendInterval.Seconds())))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"message": "Please wait before requesting another code"})
+	}
+
+	fmt.Println("Failed to send email:", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error sending email"})
+}
@@ -3,15 +3,15 @@ package controllers
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"go-auth/config"
 	"go-auth/db"
 	"go-auth/models"
 	"go-auth/utils"
-	"os"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"net/smtp"
 )
 
 func ForgotPassword(c *fiber.Ctx) error {
@@ -23,32 +23,23 @@ func ForgotPassword(c *fiber.Ctx) error {
 	if err := c.BodyParser(input); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
 	}
+	if fieldErrors := utils.Validate(input); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
 
 	var user models.User
 	if err := db.DB.Where("email = ?", input.Email).First(&user).Error; err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "User not found"})
 	}
 
-	// Generate random token
-	token := make([]byte, 16)
-	if _, err := rand.Read(token); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
-	}
-	tokenStr := hex.EncodeToString(token)
-
-	// Save reset token
-	resetRecord := models.Reset{
-		Email:     input.Email,
-		Token:     tokenStr,
-		ExpiresAt: time.Now().Add(30 * time.Minute).UnixMilli(),
-	}
-
-	if err := db.DB.Create(&resetRecord).Error; err != nil {
+	// Generate and save reset token
+	tokenStr, err := createEmailToken(input.Email, models.ResetPurposePassword, config.Get(c).ResetTokenTTL)
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error saving reset token"})
 	}
 
 	// Send email
-	if err := sendResetEmail(input.Email, tokenStr); err != nil {
+	if err := sendResetEmail(config.Get(c), input.Email, tokenStr); err != nil {
 		fmt.Println("Failed to send email:", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error sending email"})
 	}
@@ -58,23 +49,22 @@ func ForgotPassword(c *fiber.Ctx) error {
 
 func ResetPassword(c *fiber.Ctx) error {
 	type ResetInput struct {
-		Token           string `json:"token"`
-		Password        string `json:"password" validate:"required,min=6"`
-		PasswordConfirm string `json:"password_confirm" validate:"required,min=6"`
+		Token           string `json:"token" validate:"required"`
+		Password        string `json:"password" validate:"required"` // The rest is up to the password policy
+		PasswordConfirm string `json:"password_confirm" validate:"required,eqfield=Password"`
 	}
 
 	input := new(ResetInput)
 	if err := c.BodyParser(input); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
 	}
-
-	if input.Password != input.PasswordConfirm {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Passwords do not match"})
+	if fieldErrors := utils.Validate(input); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
 	}
 
 	// Find reset token
 	var resetToken models.Reset
-	if err := db.DB.Where("token = ?", input.Token).First(&resetToken).Error; err != nil {
+	if err := db.DB.Where("token = ? AND purpose = ?", input.Token, models.ResetPurposePassword).First(&resetToken).Error; err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid token"})
 	}
 
@@ -88,8 +78,12 @@ func ResetPassword(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "User not found"})
 	}
 
+	if problems := utils.CheckPassword(config.Get(c).Password, input.Password, user.Email, user.FirstName, user.LastName); problems != nil {
+		return validationFailed(c, problems)
+	}
+
 	// Update password
-	hashedPassword := utils.HashPassword(input.Password)
+	hashedPassword := utils.HashPassword(config.Get(c).Argon2, input.Password)
 	if err := db.DB.Model(&user).Update("password", hashedPassword).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error updating password"})
 	}
@@ -102,56 +96,72 @@ func ResetPassword(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"message": "Password updated successfully"})
 }
 
-func sendResetEmail(email, token string) error {
-	// Parse template
-	url := fmt.Sprintf("http://%s/reset/%s", os.Getenv("APP_HOST"), token)
-	html, err := utils.ParseTemplate("templates/forgot.html", struct {
+// createEmailToken saves a random single-use token for the email address and returns it
+func createEmailToken(email, purpose string, ttl time.Duration) (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	tokenStr := hex.EncodeToString(token)
+
+	record := models.Reset{
+		Email:     email,
+		Token:     tokenStr,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(ttl).UnixMilli(),
+	}
+
+	return tokenStr, db.DB.Create(&record).Error
+}
+
+var (
+	errInvalidEmailToken = errors.New("invalid token")
+	errEmailTokenUsed    = errors.New("token expired or already used")
+)
+
+// consumeEmailToken marks a token created by createEmailToken as used and returns it, failing
+// if it is unknown, expired or was already used, also by a parallel request
+func consumeEmailToken(token, purpose string) (models.Reset, error) {
+	var record models.Reset
+	if err := db.DB.Where("token = ? AND purpose = ?", token, purpose).First(&record).Error; err != nil {
+		return record, errInvalidEmailToken
+	}
+
+	if record.Used || record.ExpiresAt < time.Now().UnixMilli() {
+		return record, errEmailTokenUsed
+	}
+
+	result := db.DB.Model(&models.Reset{}).
+		Where("id = ? AND used = ?", record.ID, false).
+		Update("used", true)
+	if result.Error != nil {
+		return record, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return record, errEmailTokenUsed
+	}
+
+	return record, nil
+}
+
+func emailTokenError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errInvalidEmailToken) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid token"})
+	}
+	if errors.Is(err, errEmailTokenUsed) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Token expired or already used"})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error updating token"})
+}
+
+func sendResetEmail(cfg *config.Config, email, token string) error {
+	url := fmt.Sprintf("http://%s/reset/%s", cfg.AppHost, token)
+
+	return utils.SendMail(cfg.SMTP, email, "Reset Your Password", "templates/forgot.html", struct {
 		Email string
 		URL   string
 	}{
 		Email: email,
 		URL:   url,
 	})
-	if err != nil {
-		return err
-	}
-
-	// SMTP configuration
-	smtpHost := os.Getenv("SMTP_HOST")
-	smtpPort := os.Getenv("SMTP_PORT")
-	smtpUser := os.Getenv("SMTP_USER")
-	smtpPass := os.Getenv("SMTP_PASSWORD")
-	from := os.Getenv("SMTP_FROM")
-
-	// Create authentication
-	// auth := smtp.PlainAuth("", smtpUser, smtpPass, smtpHost)
-
-	// MailHog
-	var auth smtp.Auth
-	if smtpUser != "" && smtpPass != "" {
-		auth = smtp.PlainAuth("", smtpUser, smtpPass, smtpHost)
-	}
-	
-	// Email headers
-	subject := "Subject: Reset Your Password\r\n"
-	mime := "MIME-version: 1.0;\r\nContent-Type: text/html; charset=\"UTF-8\";\r\n\r\n"
-	to := []string{email}
-	msg := []byte(
-		"From: " + from + "\r\n" +
-			"To: " + email + "\r\n" +
-			subject +
-			mime +
-			html,
-	)
-
-	// Send email
-	err = smtp.SendMail(
-		smtpHost+":"+smtpPort,
-		auth,
-		from,
-		to,
-		msg,
-	)
-
-	return err
 }
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"go-auth/config"
+	"go-auth/db"
+	"go-auth/middleware"
+	"go-auth/models"
+	"go-auth/utils"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Every access token grants the same access to the user's own account
+const accessTokenScope = "user"
+
+// IntrospectionResponse is the RFC 7662 introspection response; everything but Active is omitted for inactive tokens
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Nbf       int64    `json:"nbf,omitempty"`
+	Sub       string   `json:"sub,omitempty"`
+	Aud       []string `json:"aud,omitempty"`
+	Iss       string   `json:"iss,omitempty"`
+	Jti       string   `json:"jti,omitempty"`
+	Sid       string   `json:"sid,omitempty"`
+}
+
+func Introspect(c *fiber.Ctx) error {
+	if !authenticateClient(c) {
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="introspection"`)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid_client"})
+	}
+
+	token := c.FormValue("token")
+	if token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid_request"})
+	}
+
+	// The hint only decides which kind of token is tried first
+	inspectors := []func(config.JWT, string) (IntrospectionResponse, bool){introspectAccessToken, introspectRefreshToken}
+	if c.FormValue("token_type_hint") == "refresh_token" {
+		inspectors[0], inspectors[1] = inspectors[1], inspectors[0]
+	}
+
+	for _, inspect := range inspectors {
+		if response, ok := inspect(config.Get(c).JWT, token); ok {
+			return c.JSON(response)
+		}
+	}
+
+	return c.JSON(IntrospectionResponse{Active: false})
+}
+
+// authenticateClient checks the client credentials sent with HTTP Basic or in the form body
+func authenticateClient(c *fiber.Ctx) bool {
+	clientID, clientSecret := c.FormValue("client_id"), c.FormValue("client_secret")
+	if username, password, ok := basicAuth(c); ok {
+		clientID, clientSecret = username, password
+	}
+
+	expected, ok := config.Get(c).IntrospectionClients[clientID]
+	if !ok || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(expected)) != 1 {
+		return false
+	}
+
+	return true
+}
+
+func basicAuth(c *fiber.Ctx) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Basic ")
+	if !ok {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
+
+func introspectAccessToken(cfg config.JWT, token string) (IntrospectionResponse, bool) {
+	claims, err := utils.ParseAccessToken(cfg, token)
+	if err != nil {
+		return IntrospectionResponse{}, false
+	}
+
+	user, ok := introspectedUser(claims)
+	if !ok {
+		return IntrospectionResponse{}, false
+	}
+
+	// An access token dies with the session it was issued from
+	if claims.SessionID != "" {
+		if _, err := middleware.ActiveSession(user.Id, claims.SessionID); err != nil {
+			return IntrospectionResponse{}, false
+		}
+	}
+
+	response := introspectionResponse(claims, user)
+	response.TokenType = "access_token"
+	response.Scope = accessTokenScope
+
+	return response, true
+}
+
+func introspectRefreshToken(cfg config.JWT, token string) (IntrospectionResponse, bool) {
+	claims, err := utils.ParseRefreshToken(cfg, token)
+	if err != nil {
+		return IntrospectionResponse{}, false
+	}
+
+	user, ok := introspectedUser(claims)
+	if !ok {
+		return IntrospectionResponse{}, false
+	}
+
+	// Rotated, revoked and expired refresh tokens are all inactive
+	var refreshToken models.Token
+	if err := db.DB.Where("user_id = ? AND token = ? AND used = ? AND expired_at >= ?", user.Id, token, false, time.Now()).
+		First(&refreshToken).Error; err != nil {
+		return IntrospectionResponse{}, false
+	}
+
+	response := introspectionResponse(claims, user)
+	response.TokenType = "refresh_token"
+	response.Sid = refreshToken.Family.String()
+
+	return response, true
+}
+
+func introspectedUser(claims *utils.Claims) (models.User, bool) {
+	var user models.User
+
+	userID, err := claims.UserID()
+	if err != nil || userID == uuid.Nil {
+		return user, false
+	}
+
+	if err := db.DB.First(&user, userID).Error; err != nil {
+		return user, false
+	}
+
+	return user, true
+}
+
+func introspectionResponse(claims *utils.Claims, user models.User) IntrospectionResponse {
+	response := IntrospectionResponse{
+		Active:   true,
+		Username: user.Email,
+		Sub:      user.Id.String(),
+		Aud:      claims.Audience,
+		Iss:      claims.Issuer,
+		Jti:      claims.ID,
+		Sid:      claims.SessionID,
+	}
+
+	if claims.ExpiresAt != nil {
+		response.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response.Iat = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		response.Nbf = claims.NotBefore.Unix()
+	}
+
+	return response
+}
@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"fmt"
+	"go-auth/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// JWKS publishes the public keys that verify our access tokens
+func JWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int(utils.JWKSCacheTTL.Seconds())))
+
+	return c.JSON(fiber.Map{"keys": utils.JWKS()})
+}
+
+func RotateKeys(c *fiber.Ctx) error {
+	keys := utils.AccessKeys()
+	if !keys.CanRotate() {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": "Key rotation is not enabled"})
+	}
+
+	key, err := keys.Rotate()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error rotating key"})
+	}
+
+	return c.JSON(fiber.Map{
+		"kid":       key.ID,
+		"active_at": key.CreatedAt.Add(utils.JWKSCacheTTL), // Published now, signing once cached key sets have it
+		"keys":      utils.JWKS(),
+	})
+}
@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"go-auth/db"
+	"go-auth/middleware"
+	"go-auth/models"
+	"go-auth/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ReauthenticationRequest proves the user is present before their second factors are changed.
+// A code, a recovery code or a security key assertion is only needed once the user has a second factor.
+type ReauthenticationRequest struct {
+	Password     string          `json:"password" validate:"required"`
+	Code         string          `json:"code"`
+	Method       string          `json:"method" validate:"omitempty,oneof=totp email"` // Whether Code is a "totp" or "email" code, the user's preference by default
+	RecoveryCode string          `json:"recovery_code"`
+	SessionID    string          `json:"session_id" validate:"omitempty,uuid"` // Returned by /2fa/webauthn/begin
+	Credential   json.RawMessage `json:"credential"`                           // Assertion answering the options of /2fa/webauthn/begin
+}
+
+var (
+	errInvalidRequest  = errors.New("invalid request body")
+	errInvalidPassword = errors.New("invalid password")
+)
+
+// invalidRequest carries validation failures through reauthenticate
+type invalidRequest []utils.FieldError
+
+func (e invalidRequest) Error() string {
+	return "validation failed"
+}
+
+// SendReauthenticationEmail emails a code for users whose second factor is email to change it with
+func SendReauthenticationEmail(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+	if !user.TFAEmailEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": "Email codes are not enabled"})
+	}
+
+	if err := sendEmailCode(c, user, nil); err != nil {
+		return emailCodeError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Please check your email"})
+}
+
+// DisableTwoFactor removes every second factor of the user
+func DisableTwoFactor(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	methods, err := twoFactorMethods(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading two-factor methods"})
+	}
+	if len(methods) == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": "Two-factor authentication is not enabled"})
+	}
+
+	if err := reauthenticate(c, user); err != nil {
+		return reauthenticationError(c, err)
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", user.Id).Updates(map[string]interface{}{
+			"tfa_secret":          "",
+			"tfa_pending_secret":  "",
+			"tfa_email_enabled":   false,
+			"tfa_method":          "",
+			"tfa_last_step":       0,
+			"tfa_failed_attempts": 0,
+			"tfa_locked_until":    nil,
+		}).Error; err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&models.RecoveryCode{}, &models.EmailOTP{}, &models.WebAuthnCredential{}} {
+			if err := tx.Where("user_id = ?", user.Id).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error disabling two-factor authentication"})
+	}
+
+	accessToken, err := revokeSessionsAfterFactorChange(c, user.Id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error revoking sessions"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Two-factor authentication disabled",
+		"token":   accessToken,
+	})
+}
+
+// ResetTwoFactor starts enrolling a new authenticator app. The current one keeps working
+// until a code from the new one is confirmed, which then logs out every other session.
+func ResetTwoFactor(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+	if user.TFASecret == "" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": "Two-factor authentication is not enabled"})
+	}
+
+	if err := reauthenticate(c, user); err != nil {
+		return reauthenticationError(c, err)
+	}
+
+	return enrollTOTP(c, user)
+}
+
+// reauthenticate checks the current password and a second factor from the request body
+func reauthenticate(c *fiber.Ctx, user models.User) error {
+	var req ReauthenticationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return errInvalidRequest
+	}
+	if fieldErrors := utils.Validate(req); fieldErrors != nil {
+		return invalidRequest(fieldErrors)
+	}
+	if !utils.VerifyPassword(string(user.Password), req.Password) {
+		return errInvalidPassword
+	}
+
+	methods, err := twoFactorMethods(user)
+	if err != nil {
+		return err
+	}
+	if len(methods) == 0 {
+		return nil
+	}
+
+	if req.SessionID != "" {
+		return verifyWebAuthnReauthentication(c, user, req.SessionID, req.Credential)
+	}
+
+	return verifySecondFactor(c, user, req.Method, req.Code, req.RecoveryCode, nil)
+}
+
+func reauthenticationError(c *fiber.Ctx, err error) error {
+	var fieldErrors invalidRequest
+	if errors.As(err, &fieldErrors) {
+		return validationFailed(c, fieldErrors)
+	}
+	if errors.Is(err, errInvalidRequest) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
+	}
+	if errors.Is(err, errInvalidPassword) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid password"})
+	}
+	return twoFactorError(c, err)
+}
+
+// revokeSessionsAfterFactorChange ends every session and trusted device of the user, then starts
+// a new session for the current request so the user making the change stays logged in
+func revokeSessionsAfterFactorChange(c *fiber.Ctx, userID uuid.UUID) (string, error) {
+	rememberMe := false
+	if session, ok := middleware.CurrentSession(c); ok {
+		rememberMe = session.RememberMe
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.Token{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.TrustedDevice{}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return startSession(c, userID, rememberMe)
+}
@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"go-auth/config"
+	"go-auth/db"
+	"go-auth/middleware"
+	"go-auth/models"
+	"go-auth/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// How many recovery codes a user gets at a time
+const recoveryCodeCount = 10
+
+func RecoveryCodes(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	remaining, err := remainingRecoveryCodes(user.Id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading recovery codes"})
+	}
+
+	return c.JSON(fiber.Map{"remaining": remaining})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes. It takes the password and a second factor,
+// so a stolen access token alone cannot replace them.
+func RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	methods, err := twoFactorMethods(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading two-factor methods"})
+	}
+	if len(methods) == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": "Two-factor authentication is not enabled"})
+	}
+
+	if err := reauthenticate(c, user); err != nil {
+		return reauthenticationError(c, err)
+	}
+
+	codes, err := replaceRecoveryCodes(c, user.Id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating recovery codes"})
+	}
+
+	return c.JSON(fiber.Map{"recovery_codes": codes})
+}
+
+// replaceRecoveryCodes invalidates the user's recovery codes and returns a new set, which is only ever shown once
+func replaceRecoveryCodes(c *fiber.Ctx, userID uuid.UUID) ([]string, error) {
+	codes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]models.RecoveryCode, len(codes))
+	for i, code := range codes {
+		records[i] = models.RecoveryCode{
+			UserID:   userID,
+			CodeHash: utils.HashPassword(config.Get(c).Argon2, utils.NormalizeRecoveryCode(code)),
+		}
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+
+	return codes, err
+}
+
+// recoveryCodesForNewFactor hands out recovery codes when the factor just enabled is the user's first,
+// previousMethods being their second factors before it. Later factors keep the existing codes.
+func recoveryCodesForNewFactor(c *fiber.Ctx, userID uuid.UUID, previousMethods []string) ([]string, error) {
+	if len(previousMethods) > 0 {
+		return nil, nil
+	}
+	return replaceRecoveryCodes(c, userID)
+}
+
+// useRecoveryCode consumes the matching unused recovery code of the user
+func useRecoveryCode(userID uuid.UUID, code string) bool {
+	code = utils.NormalizeRecoveryCode(code)
+	if code == "" {
+		return false
+	}
+
+	var records []models.RecoveryCode
+	if err := db.DB.Where("user_id = ? AND used = ?", userID, false).Find(&records).Error; err != nil {
+		return false
+	}
+
+	for _, record := range records {
+		if !utils.VerifyPassword(record.CodeHash, code) {
+			continue
+		}
+
+		// Only one request may consume the code
+		result := db.DB.Model(&models.RecoveryCode{}).
+			Where("id = ? AND used = ?", record.ID, false).
+			Update("used", true)
+		return result.Error == nil && result.RowsAffected == 1
+	}
+
+	return false
+}
+
+func remainingRecoveryCodes(userID uuid.UUID) (int64, error) {
+	var remaining int64
+	err := db.DB.Model(&models.RecoveryCode{}).Where("user_id = ? AND used = ?", userID, false).Count(&remaining).Error
+	return remaining, err
+}
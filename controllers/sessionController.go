@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"go-auth/db"
+	"go-auth/middleware"
+	"go-auth/models"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type SessionResponse struct {
+	ID         uuid.UUID `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	RememberMe bool      `json:"remember_me"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+func Sessions(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	// Only the latest token of each family is unused, so it stands for the whole session
+	var tokens []models.Token
+	if err := db.DB.Where("user_id = ? AND used = ? AND expired_at >= ?", user.Id, false, time.Now()).
+		Order("last_used_at DESC").
+		Find(&tokens).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading sessions"})
+	}
+
+	// Flag the session the request was made from
+	var currentFamily uuid.UUID
+	if session, ok := middleware.CurrentSession(c); ok {
+		currentFamily = session.Family
+	}
+
+	sessions := make([]SessionResponse, 0, len(tokens))
+	for _, token := range tokens {
+		sessions = append(sessions, SessionResponse{
+			ID:         token.Family,
+			UserAgent:  token.UserAgent,
+			IP:         token.IP,
+			RememberMe: token.RememberMe,
+			CreatedAt:  token.CreatedAt,
+			LastUsedAt: token.LastUsedAt,
+			ExpiresAt:  token.ExpiredAt,
+			Current:    token.Family == currentFamily,
+		})
+	}
+
+	return c.JSON(sessions)
+}
+
+func RevokeSession(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	family, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid session id"})
+	}
+
+	result := db.DB.Where("user_id = ? AND family = ?", user.Id, family).Delete(&models.Token{})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error revoking session"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Session not found"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "success",
+	})
+}
@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"go-auth/config"
+	"go-auth/db"
+	"go-auth/middleware"
+	"go-auth/models"
+	"go-auth/utils"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type TrustedDeviceResponse struct {
+	ID         uuid.UUID `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+func TrustedDevices(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	var devices []models.TrustedDevice
+	if err := db.DB.Where("user_id = ? AND expires_at >= ?", user.Id, time.Now()).
+		Order("last_used_at DESC").
+		Find(&devices).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading trusted devices"})
+	}
+
+	// Flag the device the request was made from
+	var currentDevice uuid.UUID
+	if device, ok := findTrustedDevice(c, user.Id); ok {
+		currentDevice = device.ID
+	}
+
+	response := make([]TrustedDeviceResponse, 0, len(devices))
+	for _, device := range devices {
+		response = append(response, TrustedDeviceResponse{
+			ID:         device.ID,
+			UserAgent:  device.UserAgent,
+			IP:         device.IP,
+			CreatedAt:  device.CreatedAt,
+			LastUsedAt: device.LastUsedAt,
+			ExpiresAt:  device.ExpiresAt,
+			Current:    device.ID == currentDevice,
+		})
+	}
+
+	return c.JSON(response)
+}
+
+func RevokeTrustedDevice(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid device id"})
+	}
+
+	result := db.DB.Where("user_id = ? AND id = ?", user.Id, id).Delete(&models.TrustedDevice{})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error revoking device"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Device not found"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "success",
+	})
+}
+
+func RevokeTrustedDevices(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	if err := db.DB.Where("user_id = ?", user.Id).Delete(&models.TrustedDevice{}).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error revoking devices"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "success",
+	})
+}
+
+// trustDevice remembers the current browser for the user, so its next logins skip the second factor
+func trustDevice(c *fiber.Ctx, userID uuid.UUID) error {
+	ttl := config.Get(c).TrustedDeviceTTL
+	if ttl <= 0 {
+		return nil
+	}
+
+	device := models.TrustedDevice{
+		UserID:     userID,
+		UserAgent:  c.Get(fiber.HeaderUserAgent),
+		IP:         c.IP(),
+		ExpiresAt:  time.Now().Add(ttl),
+		LastUsedAt: time.Now(),
+	}
+	if err := db.DB.Create(&device).Error; err != nil {
+		return err
+	}
+
+	// The cookie only names the device row, which can be deleted to revoke it
+	token, err := utils.GeneratePurposeToken(config.Get(c).JWT, utils.PurposeTrustedDevice, userID, device.ID, ttl)
+	if err != nil {
+		return err
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     "trusted_device",
+		Value:    token,
+		Expires:  device.ExpiresAt,
+		HTTPOnly: true,
+		Secure:   true,
+	})
+
+	return nil
+}
+
+// findTrustedDevice checks the trusted_device cookie against the user's unexpired trusted devices
+func findTrustedDevice(c *fiber.Ctx, userID uuid.UUID) (models.TrustedDevice, bool) {
+	var device models.TrustedDevice
+
+	cookie := c.Cookies("trusted_device")
+	if cookie == "" {
+		return device, false
+	}
+
+	claims, err := utils.ParsePurposeToken(config.Get(c).JWT, utils.PurposeTrustedDevice, cookie)
+	if err != nil {
+		return device, false
+	}
+
+	// A device trusted by another account in the same browser does not count
+	if tokenUserID, err := claims.UserID(); err != nil || tokenUserID != userID {
+		return device, false
+	}
+
+	err = db.DB.Where("id = ? AND user_id = ? AND expires_at >= ?", claims.ID, userID, time.Now()).First(&device).Error
+
+	return device, err == nil
+}
+
+// useTrustedDevice reports whether the request comes from a browser the user trusted, recording its use
+func useTrustedDevice(c *fiber.Ctx, userID uuid.UUID) bool {
+	device, ok := findTrustedDevice(c, userID)
+	if ok {
+		db.DB.Model(&device).Update("last_used_at", time.Now())
+	}
+	return ok
+}
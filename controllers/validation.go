@@ -0,0 +1,15 @@
+package controllers
+
+import (
+	"go-auth/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// validationFailed responds with every field that failed utils.Validate
+func validationFailed(c *fiber.Ctx, fieldErrors []utils.FieldError) error {
+	return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+		"message": "Validation failed",
+		"errors":  fieldErrors,
+	})
+}
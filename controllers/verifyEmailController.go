@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"go-auth/config"
+	"go-auth/db"
+	"go-auth/models"
+	"go-auth/utils"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// VerifyEmail marks the address the emailed token was sent to as verified
+func VerifyEmail(c *fiber.Ctx) error {
+	type VerifyInput struct {
+		Token string `json:"token" validate:"required"`
+	}
+
+	input := new(VerifyInput)
+	if err := c.BodyParser(input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
+	}
+	if fieldErrors := utils.Validate(input); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
+
+	verification, err := consumeEmailToken(input.Token, models.ResetPurposeVerifyEmail)
+	if err != nil {
+		return emailTokenError(c, err)
+	}
+
+	if err := markEmailVerified(verification.Email); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error verifying email"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Email verified"})
+}
+
+// ResendVerificationEmail sends a new verification link to an unverified address
+func ResendVerificationEmail(c *fiber.Ctx) error {
+	type ResendInput struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+
+	input := new(ResendInput)
+	if err := c.BodyParser(input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
+	}
+	if fieldErrors := utils.Validate(input); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
+
+	// Answer the same whether or not the account exists or is verified, so the endpoint cannot be used to find accounts
+	response := fiber.Map{"message": "Please check your email"}
+
+	var user models.User
+	if err := db.DB.Where("email = ?", input.Email).First(&user).Error; err != nil || user.EmailVerified {
+		return c.JSON(response)
+	}
+
+	// A throttled resend is not reported either, a 429 would only ever be seen for existing accounts
+	if err := sendVerificationEmail(config.Get(c), user); err != nil && !errors.Is(err, errResendTooSoon) {
+		fmt.Println("Failed to send verification email:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error sending email"})
+	}
+
+	return c.JSON(response)
+}
+
+// markEmailVerified records that the owner of the address proved they receive its mail,
+// keeping the time of the first verification
+func markEmailVerified(email string) error {
+	return db.DB.Model(&models.User{}).
+		Where("email = ? AND email_verified = ?", email, false).
+		Updates(map[string]interface{}{"email_verified": true, "email_verified_at": time.Now()}).Error
+}
+
+// unverifiedEmailBlocksLogin reports whether the user has to verify their address before logging in
+func unverifiedEmailBlocksLogin(c *fiber.Ctx, user models.User) bool {
+	return config.Get(c).EmailVerification.Required && !user.EmailVerified
+}
+
+// sendVerificationEmail replaces the user's pending verification link with a new one and sends it,
+// unless the previous link was sent less than the resend interval ago
+func sendVerificationEmail(cfg *config.Config, user models.User) error {
+	var recent int64
+	if err := db.DB.Model(&models.Reset{}).
+		Where("email = ? AND purpose = ? AND created_at > ?", user.Email, models.ResetPurposeVerifyEmail, time.Now().Add(-cfg.EmailVerification.ResendInterval)).
+		Count(&recent).Error; err != nil {
+		return err
+	}
+	if recent > 0 {
+		return errResendTooSoon
+	}
+
+	// Only the latest link is valid
+	if err := db.DB.Model(&models.Reset{}).
+		Where("email = ? AND purpose = ? AND used = ?", user.Email, models.ResetPurposeVerifyEmail, false).
+		Update("used", true).Error; err != nil {
+		return err
+	}
+
+	token, err := createEmailToken(user.Email, models.ResetPurposeVerifyEmail, cfg.EmailVerification.TTL)
+	if err != nil {
+		return err
+	}
+
+	return utils.SendMail(cfg.SMTP, user.Email, "Verify your email address", "templates/verify_email.html", struct {
+		Email string
+		URL   string
+	}{
+		Email: user.Email,
+		URL:   fmt.Sprintf("http://%s/verify-email/%s", cfg.AppHost, token),
+	})
+}
@@ -0,0 +1,652 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go-auth/config"
+	"go-auth/db"
+	"go-auth/middleware"
+	"go-auth/models"
+	"go-auth/utils"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type WebAuthnCredentialResponse struct {
+	ID             uuid.UUID  `json:"id"`
+	Name           string     `json:"name"`
+	Transports     []string   `json:"transports"`
+	BackupEligible bool       `json:"backup_eligible"`
+	BackupState    bool       `json:"backup_state"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at"`
+}
+
+// WebAuthnRequest is the body of the WebAuthn steps, the finish steps carry the browser's
+// response to the options returned by the matching begin step
+type WebAuthnRequest struct {
+	SessionID      string          `json:"session_id" validate:"omitempty,uuid"`
+	Credential     json.RawMessage `json:"credential"`                       // PublicKeyCredential as serialized by the browser
+	Name           string          `json:"name" validate:"omitempty,max=64"` // Only used when registering
+	ChallengeToken string          `json:"challenge_token"`
+	RememberMe     bool            `json:"rememberMe"`
+	TrustDevice    bool            `json:"trust_device"` // Only used for the second factor
+}
+
+// webAuthnUser exposes a user and their credentials to the WebAuthn library
+type webAuthnUser struct {
+	user        models.User
+	credentials []models.WebAuthnCredential
+}
+
+func (u webAuthnUser) WebAuthnID() []byte {
+	return u.user.Id[:]
+}
+
+func (u webAuthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	if name := strings.TrimSpace(u.user.FirstName + " " + u.user.LastName); name != "" {
+		return name
+	}
+	return u.user.Email
+}
+
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, credential := range u.credentials {
+		credentials = append(credentials, webauthn.Credential{
+			ID:              credential.CredentialID,
+			PublicKey:       credential.PublicKey,
+			AttestationType: credential.AttestationType,
+			Transport:       credentialTransports(credential),
+			Flags: webauthn.CredentialFlags{
+				UserVerified:   credential.UserVerified,
+				BackupEligible: credential.BackupEligible,
+				BackupState:    credential.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    credential.AAGUID,
+				SignCount: credential.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+func credentialTransports(credential models.WebAuthnCredential) []protocol.AuthenticatorTransport {
+	var transports []protocol.AuthenticatorTransport
+	for _, transport := range strings.Split(credential.Transports, ",") {
+		if transport != "" {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+	}
+	return transports
+}
+
+// relyingParty creates the WebAuthn relying party from the settings of the request's app
+func relyingParty(c *fiber.Ctx) (*webauthn.WebAuthn, error) {
+	return utils.NewWebAuthn(config.Get(c).WebAuthn)
+}
+
+func loadWebAuthnUser(userID uuid.UUID) (webAuthnUser, error) {
+	var u webAuthnUser
+
+	if err := db.DB.First(&u.user, "id = ?", userID).Error; err != nil {
+		return u, err
+	}
+
+	err := db.DB.Where("user_id = ?", userID).Order("created_at").Find(&u.credentials).Error
+
+	return u, err
+}
+
+// BeginWebAuthnRegistration starts adding a security key or passkey. As a passkey logs in on its own,
+// the request has to reauthenticate like any other change of second factors.
+func BeginWebAuthnRegistration(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+	if err := reauthenticate(c, user); err != nil {
+		return reauthenticationError(c, err)
+	}
+
+	u, err := loadWebAuthnUser(user.Id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading credentials"})
+	}
+
+	// Keep the authenticator from registering a second credential for the same account
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(u.credentials))
+	for _, credential := range u.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	rp, err := relyingParty(c)
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting registration"})
+	}
+
+	options, session, err := rp.BeginRegistration(u, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting registration"})
+	}
+
+	sessionID, err := saveWebAuthnSession(c, models.WebAuthnRegistration, &u.user.Id, nil, session)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting registration"})
+	}
+
+	return c.JSON(fiber.Map{"session_id": sessionID, "options": options})
+}
+
+func FinishWebAuthnRegistration(c *fiber.Ctx) error {
+	var req WebAuthnRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
+	}
+	if fieldErrors := utils.Validate(req); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
+
+	u, err := loadWebAuthnUser(middleware.CurrentUser(c).Id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading credentials"})
+	}
+
+	_, session, err := consumeWebAuthnSession(req.SessionID, models.WebAuthnRegistration, &u.user.Id)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid or expired registration"})
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(req.Credential))
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credential"})
+	}
+
+	rp, err := relyingParty(c)
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error verifying credential"})
+	}
+
+	credential, err := rp.CreateCredential(u, session, parsed)
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credential"})
+	}
+
+	transports := make([]string, len(credential.Transport))
+	for i, transport := range credential.Transport {
+		transports[i] = string(transport)
+	}
+
+	methods, err := twoFactorMethods(u.user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading two-factor methods"})
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Security key"
+	}
+
+	record := models.WebAuthnCredential{
+		UserID:          u.user.Id,
+		Name:            name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		UserVerified:    credential.Flags.UserVerified,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+	if err := db.DB.Create(&record).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error saving credential"})
+	}
+
+	response := fiber.Map{
+		"message":    "Credential registered",
+		"credential": webAuthnCredentialResponse(record),
+	}
+
+	codes, err := recoveryCodesForNewFactor(c, u.user.Id, methods)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating recovery codes"})
+	}
+	if codes != nil {
+		response["recovery_codes"] = codes
+	}
+
+	// A new way to log in ends every other session, like replacing the authenticator app does
+	accessToken, err := revokeSessionsAfterFactorChange(c, u.user.Id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error revoking sessions"})
+	}
+	response["token"] = accessToken
+
+	return c.JSON(response)
+}
+
+func WebAuthnCredentials(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	var credentials []models.WebAuthnCredential
+	if err := db.DB.Where("user_id = ?", user.Id).Order("created_at").Find(&credentials).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading credentials"})
+	}
+
+	response := make([]WebAuthnCredentialResponse, 0, len(credentials))
+	for _, credential := range credentials {
+		response = append(response, webAuthnCredentialResponse(credential))
+	}
+
+	return c.JSON(response)
+}
+
+// DeleteWebAuthnCredential removes a security key. Removing the last second factor turns 2FA off,
+// so it takes the same reauthentication as disabling it, which is why it is a POST with a body.
+func DeleteWebAuthnCredential(c *fiber.Ctx) error {
+	user := middleware.CurrentUser(c)
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credential id"})
+	}
+
+	var credential models.WebAuthnCredential
+	if err := db.DB.Where("user_id = ? AND id = ?", user.Id, id).First(&credential).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Credential not found"})
+	}
+
+	if err := reauthenticate(c, user); err != nil {
+		return reauthenticationError(c, err)
+	}
+
+	result := db.DB.Where("user_id = ? AND id = ?", user.Id, id).Delete(&models.WebAuthnCredential{})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error deleting credential"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Credential not found"})
+	}
+
+	// Recovery codes have nothing left to stand in for once the last second factor is gone
+	methods, err := twoFactorMethods(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading two-factor methods"})
+	}
+	if len(methods) == 0 {
+		if err := db.DB.Where("user_id = ?", user.Id).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error deleting recovery codes"})
+		}
+	}
+
+	accessToken, err := revokeSessionsAfterFactorChange(c, user.Id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error revoking sessions"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "success",
+		"token":   accessToken,
+	})
+}
+
+func webAuthnCredentialResponse(credential models.WebAuthnCredential) WebAuthnCredentialResponse {
+	transports := []string{}
+	for _, transport := range credentialTransports(credential) {
+		transports = append(transports, string(transport))
+	}
+
+	return WebAuthnCredentialResponse{
+		ID:             credential.ID,
+		Name:           credential.Name,
+		Transports:     transports,
+		BackupEligible: credential.BackupEligible,
+		BackupState:    credential.BackupState,
+		CreatedAt:      credential.CreatedAt,
+		LastUsedAt:     credential.LastUsedAt,
+	}
+}
+
+// BeginWebAuthnTwoFactor starts a security key assertion for the second step of a login
+func BeginWebAuthnTwoFactor(c *fiber.Ctx) error {
+	var req WebAuthnRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
+	}
+	if fieldErrors := utils.Validate(req); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
+
+	challenge, err := findChallenge(c, req.ChallengeToken)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Invalid or expired challenge"})
+	}
+
+	u, err := loadWebAuthnUser(challenge.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credentials"})
+	}
+	if len(u.credentials) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "No security keys registered"})
+	}
+
+	rp, err := relyingParty(c)
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting login"})
+	}
+
+	options, session, err := rp.BeginLogin(u)
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting login"})
+	}
+
+	sessionID, err := saveWebAuthnSession(c, models.WebAuthnSecondFactor, &u.user.Id, &challenge.ID, session)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting login"})
+	}
+
+	return c.JSON(fiber.Map{"session_id": sessionID, "options": options})
+}
+
+// FinishWebAuthnTwoFactor completes the login with the assertion, in place of a TOTP code
+func FinishWebAuthnTwoFactor(c *fiber.Ctx) error {
+	var req WebAuthnRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
+	}
+	if fieldErrors := utils.Validate(req); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
+
+	challenge, err := attemptChallenge(c, req.ChallengeToken)
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Invalid or expired challenge"})
+	}
+
+	record, session, err := consumeWebAuthnSession(req.SessionID, models.WebAuthnSecondFactor, &challenge.UserID)
+	if err != nil || record.ChallengeID == nil || *record.ChallengeID != challenge.ID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid or expired login"})
+	}
+
+	u, err := loadWebAuthnUser(challenge.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credentials"})
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(req.Credential))
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credentials"})
+	}
+
+	rp, err := relyingParty(c)
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error verifying credentials"})
+	}
+
+	credential, err := rp.ValidateLogin(u, session, parsed)
+	if err == nil {
+		err = recordCredentialUse(credential)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credentials"})
+	}
+
+	// The challenge can only be completed once
+	if err := completeChallenge(challenge); err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Invalid or expired challenge"})
+	}
+
+	if req.TrustDevice {
+		if err := trustDevice(c, u.user.Id); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error trusting device"})
+		}
+	}
+
+	accessToken, err := startSession(c, u.user.Id, req.RememberMe || challenge.RememberMe)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
+	}
+
+	return c.JSON(fiber.Map{"token": accessToken})
+}
+
+// BeginWebAuthnReauthentication starts a security key assertion that reauthenticate accepts as the second factor
+func BeginWebAuthnReauthentication(c *fiber.Ctx) error {
+	u, err := loadWebAuthnUser(middleware.CurrentUser(c).Id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error loading credentials"})
+	}
+	if len(u.credentials) == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": "No security keys registered"})
+	}
+
+	rp, err := relyingParty(c)
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting reauthentication"})
+	}
+
+	options, session, err := rp.BeginLogin(u)
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting reauthentication"})
+	}
+
+	sessionID, err := saveWebAuthnSession(c, models.WebAuthnReauthentication, &u.user.Id, nil, session)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting reauthentication"})
+	}
+
+	return c.JSON(fiber.Map{"session_id": sessionID, "options": options})
+}
+
+// verifyWebAuthnReauthentication checks an assertion answering a reauthentication ceremony of the user
+func verifyWebAuthnReauthentication(c *fiber.Ctx, user models.User, sessionID string, assertion json.RawMessage) error {
+	_, session, err := consumeWebAuthnSession(sessionID, models.WebAuthnReauthentication, &user.Id)
+	if err != nil {
+		return errInvalidCode
+	}
+
+	u, err := loadWebAuthnUser(user.Id)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(assertion))
+	if err != nil {
+		fmt.Println(err)
+		return errInvalidCode
+	}
+
+	rp, err := relyingParty(c)
+	if err != nil {
+		return err
+	}
+
+	credential, err := rp.ValidateLogin(u, session, parsed)
+	if err == nil {
+		err = recordCredentialUse(credential)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return errInvalidCode
+	}
+
+	return nil
+}
+
+// BeginPasskeyLogin starts a passwordless login, where the authenticator picks the account
+func BeginPasskeyLogin(c *fiber.Ctx) error {
+	// The passkey replaces both the password and the second factor, so the user must be verified
+	rp, err := relyingParty(c)
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting login"})
+	}
+
+	options, session, err := rp.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting login"})
+	}
+
+	sessionID, err := saveWebAuthnSession(c, models.WebAuthnPasswordless, nil, nil, session)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error starting login"})
+	}
+
+	return c.JSON(fiber.Map{"session_id": sessionID, "options": options})
+}
+
+func FinishPasskeyLogin(c *fiber.Ctx) error {
+	var req WebAuthnRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid request"})
+	}
+	if fieldErrors := utils.Validate(req); fieldErrors != nil {
+		return validationFailed(c, fieldErrors)
+	}
+
+	_, session, err := consumeWebAuthnSession(req.SessionID, models.WebAuthnPasswordless, nil)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid or expired login"})
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(req.Credential))
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credentials"})
+	}
+
+	// The user handle the authenticator returns is the user ID it was registered with
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		userID, err := uuid.FromBytes(userHandle)
+		if err != nil {
+			return nil, err
+		}
+		return loadWebAuthnUser(userID)
+	}
+
+	rp, err := relyingParty(c)
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error verifying credentials"})
+	}
+
+	user, credential, err := rp.ValidatePasskeyLogin(findUser, session, parsed)
+	if err == nil {
+		err = recordCredentialUse(credential)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid credentials"})
+	}
+
+	if unverifiedEmailBlocksLogin(c, user.(webAuthnUser).user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": "Email address is not verified"})
+	}
+
+	accessToken, err := startSession(c, user.(webAuthnUser).user.Id, req.RememberMe)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Error generating token"})
+	}
+
+	return c.JSON(fiber.Map{
+		"token":      accessToken,
+		"rememberMe": req.RememberMe,
+	})
+}
+
+// recordCredentialUse stores the new signature counter, refusing credentials that look cloned
+func recordCredentialUse(credential *webauthn.Credential) error {
+	if credential.Authenticator.CloneWarning {
+		return fmt.Errorf("signature counter went backwards, the credential may be cloned")
+	}
+
+	return db.DB.Model(&models.WebAuthnCredential{}).
+		Where("credential_id = ?", credential.ID).
+		Updates(map[string]interface{}{
+			"sign_count":   credential.Authenticator.SignCount,
+			"backup_state": credential.Flags.BackupState,
+			"last_used_at": time.Now(),
+		}).Error
+}
+
+// saveWebAuthnSession keeps the ceremony data until the finish step and returns its ID
+func saveWebAuthnSession(c *fiber.Ctx, ceremony string, userID, challengeID *uuid.UUID, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	record := models.WebAuthnSession{
+		UserID:      userID,
+		ChallengeID: challengeID,
+		Ceremony:    ceremony,
+		Data:        data,
+		ExpiresAt:   time.Now().Add(config.Get(c).WebAuthn.Timeout),
+	}
+	if err := db.DB.Create(&record).Error; err != nil {
+		return "", err
+	}
+
+	return record.ID.String(), nil
+}
+
+// consumeWebAuthnSession marks a ceremony as used, so every challenge can only be answered once
+func consumeWebAuthnSession(id, ceremony string, userID *uuid.UUID) (models.WebAuthnSession, webauthn.SessionData, error) {
+	var record models.WebAuthnSession
+	var session webauthn.SessionData
+
+	sessionID, err := uuid.Parse(id)
+	if err != nil {
+		return record, session, err
+	}
+
+	query := db.DB.Model(&models.WebAuthnSession{}).
+		Where("id = ? AND ceremony = ? AND used = ? AND expires_at >= ?", sessionID, ceremony, false, time.Now())
+	if userID != nil {
+		query = query.Where("user_id = ?", *userID)
+	} else {
+		query = query.Where("user_id IS NULL")
+	}
+
+	result := query.Update("used", true)
+	if result.Error != nil {
+		return record, session, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return record, session, gorm.ErrRecordNotFound
+	}
+
+	if err := db.DB.First(&record, "id = ?", sessionID).Error; err != nil {
+		return record, session, err
+	}
+
+	err = json.Unmarshal(record.Data, &session)
+
+	return record, session, err
+}
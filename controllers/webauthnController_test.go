@@ -0,0 +1,534 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"go-auth/config"
+	"go-auth/db"
+	"go-auth/middleware"
+	"go-auth/models"
+	"go-auth/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	testRPID     = "localhost"
+	testOrigin   = "https://localhost"
+	testPassword = "correct horse battery staple"
+)
+
+// sqliteUUID stands in for Postgres' gen_random_uuid() in the column defaults
+const sqliteUUID = "(lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-' || hex(randomblob(2)) || '-' || hex(randomblob(2)) || '-' || hex(randomblob(6))))"
+
+// setupWebAuthnTest points db.DB at a fresh SQLite database and returns an app with the WebAuthn routes
+func setupWebAuthnTest(t *testing.T) *fiber.App {
+	t.Helper()
+
+	gdb, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []interface{}{&models.User{}, &models.Token{}, &models.MFAChallenge{}, &models.RecoveryCode{}, &models.EmailOTP{},
+		&models.WebAuthnCredential{}, &models.WebAuthnSession{}, &models.TrustedDevice{}}
+	for _, table := range tables {
+		stmt := &gorm.Statement{DB: gdb}
+		if err := stmt.Parse(table); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DefaultValue == "gen_random_uuid()" {
+				field.DefaultValue = sqliteUUID
+			}
+		}
+	}
+	if err := gdb.AutoMigrate(tables...); err != nil {
+		t.Fatal(err)
+	}
+	db.DB = gdb
+
+	cfg := testConfig()
+	if err := utils.LoadAccessKeys(cfg.JWT); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Use(config.Middleware(cfg))
+	app.Post("/api/login", Login)
+	app.Post("/api/two-factor/webauthn/begin", BeginWebAuthnTwoFactor)
+	app.Post("/api/two-factor/webauthn/finish", FinishWebAuthnTwoFactor)
+	app.Post("/api/webauthn/login/begin", BeginPasskeyLogin)
+	app.Post("/api/webauthn/login/finish", FinishPasskeyLogin)
+
+	user := app.Group("/api/user", middleware.Authenticated)
+	user.Post("/2fa/webauthn/begin", BeginWebAuthnReauthentication)
+	user.Post("/2fa/recovery-codes", RegenerateRecoveryCodes)
+	user.Post("/webauthn/register/begin", BeginWebAuthnRegistration)
+	user.Post("/webauthn/register/finish", FinishWebAuthnRegistration)
+
+	return app
+}
+
+// testConfig holds the settings every test app runs with
+func testConfig() *config.Config {
+	return &config.Config{
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 7 * 24 * time.Hour,
+		RememberMeTTL:   365 * 24 * time.Hour,
+		MFAChallengeTTL: 5 * time.Minute,
+		MFAMaxAttempts:  5,
+		JWT:             config.JWT{SigningAlg: "HS256", SecretAccess: "test-access-secret", SecretRefresh: "test-refresh-secret"},
+		Argon2:          config.Argon2{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		WebAuthn:        config.WebAuthn{RPID: testRPID, RPDisplayName: "Go Auth", RPOrigins: []string{testOrigin}, Timeout: 5 * time.Minute},
+	}
+}
+
+// createTestUser saves a user and returns an access token of a new session of theirs
+func createTestUser(t *testing.T) (models.User, string) {
+	t.Helper()
+
+	user := models.User{
+		FirstName: "Test",
+		Email:     "test@example.com",
+		Password:  []byte(utils.HashPassword(testConfig().Argon2, testPassword)),
+	}
+	if err := db.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	session := models.Token{
+		User_id:   user.Id,
+		Family:    uuid.New(),
+		Token:     uuid.NewString(),
+		ExpiredAt: time.Now().Add(time.Hour),
+	}
+	if err := db.DB.Create(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := utils.GenerateAccessToken(testConfig().JWT, user.Id, session.Family, 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, token
+}
+
+// request sends a JSON request and decodes the JSON response into out, when given
+func request(t *testing.T, app *fiber.App, path, accessToken string, body interface{}, out interface{}) int {
+	t.Helper()
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if accessToken != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+accessToken)
+	}
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s: decoding response: %v", path, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+// ceremonyResponse is the part of a begin step's response the authenticator needs
+type ceremonyResponse struct {
+	SessionID string `json:"session_id"`
+	Options   struct {
+		PublicKey struct {
+			Challenge protocol.URLEncodedBase64 `json:"challenge"`
+		} `json:"publicKey"`
+	} `json:"options"`
+}
+
+// softAuthenticator is a P-256 authenticator kept in memory, which always verifies the user
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, userID uuid.UUID) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialID := make([]byte, 32)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+
+	return &softAuthenticator{key: key, credentialID: credentialID, userHandle: userID[:]}
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    testOrigin,
+	})
+	return data
+}
+
+// authenticatorData builds the RP ID hash, flags and counter, followed by the credential when attesting
+func (a *softAuthenticator) authenticatorData(t *testing.T, attest bool) []byte {
+	t.Helper()
+
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	flags := protocol.FlagUserPresent | protocol.FlagUserVerified
+	if attest {
+		flags |= protocol.FlagAttestedCredentialData
+	}
+
+	data := append(rpIDHash[:], byte(flags))
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if !attest {
+		return data
+	}
+
+	publicKey, err := webauthncbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+	data = append(data, a.credentialID...)
+	return append(data, publicKey...)
+}
+
+// create answers a registration's options with a "none" attestation
+func (a *softAuthenticator) create(t *testing.T, options ceremonyResponse) json.RawMessage {
+	t.Helper()
+
+	attestationObject, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authenticatorData(t, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", options.Options.PublicKey.Challenge)),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+	})
+}
+
+// get answers a login's options with a signed assertion, counting the use first
+func (a *softAuthenticator) get(t *testing.T, options ceremonyResponse) json.RawMessage {
+	t.Helper()
+
+	a.signCount++
+	authenticatorData := a.authenticatorData(t, false)
+	clientData := a.clientData("webauthn.get", options.Options.PublicKey.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authenticatorData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authenticatorData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+	})
+}
+
+func (a *softAuthenticator) credential(response map[string]string) json.RawMessage {
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	credential, _ := json.Marshal(map[string]interface{}{
+		"id":       id,
+		"rawId":    id,
+		"type":     "public-key",
+		"response": response,
+	})
+	return credential
+}
+
+// registerSoftAuthenticator runs the registration ceremony and returns the new session's access token
+func registerSoftAuthenticator(t *testing.T, app *fiber.App, accessToken string, authenticator *softAuthenticator) string {
+	t.Helper()
+
+	var begin ceremonyResponse
+	if status := request(t, app, "/api/user/webauthn/register/begin", accessToken, ReauthenticationRequest{Password: testPassword}, &begin); status != fiber.StatusOK {
+		t.Fatalf("begin registration: status %d", status)
+	}
+
+	var finish struct {
+		Token         string   `json:"token"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	status := request(t, app, "/api/user/webauthn/register/finish", accessToken, WebAuthnRequest{
+		SessionID:  begin.SessionID,
+		Credential: authenticator.create(t, begin),
+		Name:       "Soft key",
+	}, &finish)
+	if status != fiber.StatusOK {
+		t.Fatalf("finish registration: status %d", status)
+	}
+	if len(finish.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("got %d recovery codes with the first second factor, want %d", len(finish.RecoveryCodes), recoveryCodeCount)
+	}
+
+	return finish.Token
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	app := setupWebAuthnTest(t)
+	user, accessToken := createTestUser(t)
+	authenticator := newSoftAuthenticator(t, user.Id)
+
+	var begin ceremonyResponse
+	if status := request(t, app, "/api/user/webauthn/register/begin", accessToken, ReauthenticationRequest{Password: testPassword}, &begin); status != fiber.StatusOK {
+		t.Fatalf("begin registration: status %d", status)
+	}
+
+	finish := WebAuthnRequest{SessionID: begin.SessionID, Credential: authenticator.create(t, begin)}
+
+	var registered struct {
+		Token      string                     `json:"token"`
+		Credential WebAuthnCredentialResponse `json:"credential"`
+	}
+	if status := request(t, app, "/api/user/webauthn/register/finish", accessToken, finish, &registered); status != fiber.StatusOK {
+		t.Fatalf("finish registration: status %d", status)
+	}
+	if registered.Credential.Name != "Security key" {
+		t.Errorf("got credential name %q, want the default", registered.Credential.Name)
+	}
+
+	var stored models.WebAuthnCredential
+	if err := db.DB.Where("user_id = ?", user.Id).First(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.CredentialID, authenticator.credentialID) || !stored.UserVerified {
+		t.Errorf("stored credential does not match the authenticator")
+	}
+
+	// Adding a way to log in ends the other sessions, the new token belongs to a fresh one
+	if status := request(t, app, "/api/user/webauthn/register/begin", accessToken, ReauthenticationRequest{Password: testPassword}, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("old access token after registration: status %d, want 401", status)
+	}
+
+	// The registration session can only be finished once
+	if status := request(t, app, "/api/user/webauthn/register/finish", registered.Token, finish, nil); status != fiber.StatusBadRequest {
+		t.Errorf("replayed session_id: status %d, want 400", status)
+	}
+}
+
+func TestWebAuthnRegistrationRequiresReauthentication(t *testing.T) {
+	app := setupWebAuthnTest(t)
+	_, accessToken := createTestUser(t)
+
+	var malformed struct {
+		Message string `json:"message"`
+	}
+	if status := request(t, app, "/api/user/webauthn/register/begin", accessToken, "not an object", &malformed); status != fiber.StatusBadRequest || malformed.Message != "Invalid request" {
+		t.Errorf("malformed body: status %d %q, want 400 \"Invalid request\"", status, malformed.Message)
+	}
+	if status := request(t, app, "/api/user/webauthn/register/begin", accessToken, fiber.Map{}, nil); status != fiber.StatusUnprocessableEntity {
+		t.Errorf("without password: status %d, want 422", status)
+	}
+	if status := request(t, app, "/api/user/webauthn/register/begin", accessToken, ReauthenticationRequest{Password: "wrong"}, nil); status != fiber.StatusBadRequest {
+		t.Errorf("wrong password: status %d, want 400", status)
+	}
+	if status := request(t, app, "/api/user/webauthn/register/begin", accessToken, ReauthenticationRequest{Password: testPassword}, nil); status != fiber.StatusOK {
+		t.Errorf("with password: status %d, want 200", status)
+	}
+}
+
+func TestWebAuthnTwoFactor(t *testing.T) {
+	app := setupWebAuthnTest(t)
+	user, accessToken := createTestUser(t)
+	authenticator := newSoftAuthenticator(t, user.Id)
+	registerSoftAuthenticator(t, app, accessToken, authenticator)
+
+	var login struct {
+		ChallengeToken string   `json:"challenge_token"`
+		Methods        []string `json:"methods"`
+	}
+	if status := request(t, app, "/api/login", "", fiber.Map{"email": user.Email, "password": testPassword}, &login); status != fiber.StatusOK {
+		t.Fatalf("login: status %d", status)
+	}
+	if login.ChallengeToken == "" || len(login.Methods) != 1 || login.Methods[0] != methodWebAuthn {
+		t.Fatalf("login did not ask for the security key: %+v", login)
+	}
+
+	var begin ceremonyResponse
+	if status := request(t, app, "/api/two-factor/webauthn/begin", "", WebAuthnRequest{ChallengeToken: login.ChallengeToken}, &begin); status != fiber.StatusOK {
+		t.Fatalf("begin second factor: status %d", status)
+	}
+
+	finish := WebAuthnRequest{SessionID: begin.SessionID, ChallengeToken: login.ChallengeToken, Credential: authenticator.get(t, begin)}
+
+	var session struct {
+		Token string `json:"token"`
+	}
+	if status := request(t, app, "/api/two-factor/webauthn/finish", "", finish, &session); status != fiber.StatusOK || session.Token == "" {
+		t.Fatalf("finish second factor: status %d", status)
+	}
+
+	var stored models.WebAuthnCredential
+	if err := db.DB.Where("user_id = ?", user.Id).First(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.SignCount != authenticator.signCount || stored.LastUsedAt == nil {
+		t.Errorf("credential use was not recorded: sign count %d, want %d", stored.SignCount, authenticator.signCount)
+	}
+
+	// Neither the session nor the challenge it belongs to can be used again
+	finish.Credential = authenticator.get(t, begin)
+	if status := request(t, app, "/api/two-factor/webauthn/finish", "", finish, nil); status == fiber.StatusOK {
+		t.Errorf("replayed session_id was accepted")
+	}
+}
+
+func TestReauthenticationWithSecurityKey(t *testing.T) {
+	app := setupWebAuthnTest(t)
+	user, accessToken := createTestUser(t)
+	authenticator := newSoftAuthenticator(t, user.Id)
+	accessToken = registerSoftAuthenticator(t, app, accessToken, authenticator)
+
+	if status := request(t, app, "/api/user/2fa/recovery-codes", accessToken, ReauthenticationRequest{Password: testPassword}, nil); status == fiber.StatusOK {
+		t.Fatalf("recovery codes were replaced without a second factor")
+	}
+
+	var begin ceremonyResponse
+	if status := request(t, app, "/api/user/2fa/webauthn/begin", accessToken, nil, &begin); status != fiber.StatusOK {
+		t.Fatalf("begin reauthentication: status %d", status)
+	}
+
+	reauthentication := ReauthenticationRequest{Password: testPassword, SessionID: begin.SessionID, Credential: authenticator.get(t, begin)}
+
+	var regenerated struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if status := request(t, app, "/api/user/2fa/recovery-codes", accessToken, reauthentication, &regenerated); status != fiber.StatusOK {
+		t.Fatalf("regenerate with security key: status %d", status)
+	}
+	if len(regenerated.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("got %d recovery codes, want %d", len(regenerated.RecoveryCodes), recoveryCodeCount)
+	}
+
+	// The assertion is bound to the ceremony, which can only be answered once
+	reauthentication.Credential = authenticator.get(t, begin)
+	if status := request(t, app, "/api/user/2fa/recovery-codes", accessToken, reauthentication, nil); status == fiber.StatusOK {
+		t.Errorf("replayed session_id was accepted")
+	}
+
+	// Nor does the security key stand in for the password
+	reauthentication.Password = "wrong"
+	if status := request(t, app, "/api/user/2fa/webauthn/begin", accessToken, nil, &begin); status != fiber.StatusOK {
+		t.Fatalf("begin reauthentication: status %d", status)
+	}
+	reauthentication.SessionID, reauthentication.Credential = begin.SessionID, authenticator.get(t, begin)
+	if status := request(t, app, "/api/user/2fa/recovery-codes", accessToken, reauthentication, nil); status != fiber.StatusBadRequest {
+		t.Errorf("wrong password with security key: status %d, want 400", status)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	app := setupWebAuthnTest(t)
+	user, accessToken := createTestUser(t)
+	authenticator := newSoftAuthenticator(t, user.Id)
+	registerSoftAuthenticator(t, app, accessToken, authenticator)
+
+	var begin ceremonyResponse
+	if status := request(t, app, "/api/webauthn/login/begin", "", fiber.Map{}, &begin); status != fiber.StatusOK {
+		t.Fatalf("begin passkey login: status %d", status)
+	}
+
+	var session struct {
+		Token string `json:"token"`
+	}
+	finish := WebAuthnRequest{SessionID: begin.SessionID, Credential: authenticator.get(t, begin)}
+	if status := request(t, app, "/api/webauthn/login/finish", "", finish, &session); status != fiber.StatusOK || session.Token == "" {
+		t.Fatalf("finish passkey login: status %d", status)
+	}
+
+	// A new, validly signed assertion for the same session is still refused
+	finish.Credential = authenticator.get(t, begin)
+	if status := request(t, app, "/api/webauthn/login/finish", "", finish, nil); status != fiber.StatusBadRequest {
+		t.Errorf("replayed session_id: status %d, want 400", status)
+	}
+}
+
+func TestPasskeyLoginRefusesClonedCredential(t *testing.T) {
+	app := setupWebAuthnTest(t)
+	user, accessToken := createTestUser(t)
+	authenticator := newSoftAuthenticator(t, user.Id)
+	registerSoftAuthenticator(t, app, accessToken, authenticator)
+
+	login := func() int {
+		var begin ceremonyResponse
+		if status := request(t, app, "/api/webauthn/login/begin", "", fiber.Map{}, &begin); status != fiber.StatusOK {
+			t.Fatalf("begin passkey login: status %d", status)
+		}
+		finish := WebAuthnRequest{SessionID: begin.SessionID, Credential: authenticator.get(t, begin)}
+		return request(t, app, "/api/webauthn/login/finish", "", finish, nil)
+	}
+
+	authenticator.signCount = 9
+	if status := login(); status != fiber.StatusOK {
+		t.Fatalf("login with counter 10: status %d", status)
+	}
+
+	// A copy of the key that was used less often reports a lower counter
+	authenticator.signCount = 4
+	if status := login(); status != fiber.StatusBadRequest {
+		t.Errorf("login with counter 5 after 10: status %d, want 400", status)
+	}
+
+	var stored models.WebAuthnCredential
+	if err := db.DB.Where("user_id = ?", user.Id).First(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.SignCount != 10 {
+		t.Errorf("sign count %d after the refused login, want 10", stored.SignCount)
+	}
+}
@@ -1,30 +1,15 @@
 package db
 
 import (
-	"github.com/joho/godotenv"
 	"go-auth/models"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"log"
-	"os"
 )
 
 var DB *gorm.DB
 
-func Connect() {
-
-	err := godotenv.Load()
-
-	if err != nil {
-		log.Println("Warning: No .env file found, using system environment variables")
-	}
-
-	dsn := os.Getenv("DATABASE_URL")
-
-	if dsn == "" {
-		log.Fatal("DATABASE_URL is not set in environment variables")
-	}
-
+func Connect(dsn string) {
 	// Connect to PostgreSQL using GORM
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	DB = db
@@ -33,7 +18,8 @@ func Connect() {
 		log.Fatal("Failed to connect to the database:", err)
 	}
 
-	db.AutoMigrate(&models.User{}, &models.Token{}, &models.Reset{})
+	db.AutoMigrate(&models.User{}, &models.Token{}, &models.Reset{}, &models.MFAChallenge{}, &models.RecoveryCode{}, &models.EmailOTP{},
+		&models.WebAuthnCredential{}, &models.WebAuthnSession{}, &models.TrustedDevice{})
 
 	log.Println("Connected to the database successfully!")
 }
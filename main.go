@@ -2,16 +2,40 @@ package main
 
 import (
 	"github.com/gofiber/fiber/v2"
+	"go-auth/config"
 	"go-auth/db"
 	"go-auth/routes"
+	"go-auth/utils"
+	"log"
 )
 
 func main() {
-	db.Connect()
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
 
-    app := fiber.New()
+	db.Connect(cfg.DatabaseURL)
 
-	routes.Setup(app)
-	
-    app.Listen(":8000")
+	if err := utils.LoadAccessKeys(cfg.JWT); err != nil {
+		log.Fatal("Failed to load JWT signing key: ", err)
+	}
+
+	if err := utils.LoadBreachedPasswords(cfg.Password); err != nil {
+		log.Fatal("Failed to load breached password list: ", err)
+	}
+
+	if _, err := utils.NewWebAuthn(cfg.WebAuthn); err != nil {
+		log.Fatal(err)
+	}
+
+	if keys := utils.AccessKeys(); keys.CanRotate() {
+		keys.StartRotation(cfg.JWT.KeyRotationInterval)
+	}
+
+	app := fiber.New()
+
+	routes.Setup(app, cfg)
+
+	log.Fatal(app.Listen(":" + cfg.Port))
 }
@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"go-auth/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Admin only lets through requests carrying the configured admin API key in the X-Admin-Key header
+func Admin(c *fiber.Ctx) error {
+	adminKey := config.Get(c).AdminAPIKey
+	if adminKey == "" || subtle.ConstantTimeCompare([]byte(c.Get("X-Admin-Key")), []byte(adminKey)) != 1 {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": "Forbidden"})
+	}
+
+	return c.Next()
+}
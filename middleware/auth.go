@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"fmt"
+	"go-auth/config"
+	"go-auth/db"
+	"go-auth/models"
+	"go-auth/utils"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Authenticated verifies the bearer access token and stores the user in c.Locals("user")
+func Authenticated(c *fiber.Ctx) error {
+	user, err := authenticate(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "Unauthenticated"})
+	}
+
+	c.Locals("user", user)
+
+	return c.Next()
+}
+
+// CurrentUser returns the user stored by Authenticated
+func CurrentUser(c *fiber.Ctx) models.User {
+	user, _ := c.Locals("user").(models.User)
+	return user
+}
+
+// CurrentSession returns the refresh token of the session the access token was issued from,
+// which is missing for tokens issued before sessions were tracked
+func CurrentSession(c *fiber.Ctx) (models.Token, bool) {
+	session, ok := c.Locals("session").(models.Token)
+	return session, ok
+}
+
+func authenticate(c *fiber.Ctx) (models.User, error) {
+	var user models.User
+
+	authHeader := c.Get("Authorization")
+	if authHeader == "" {
+		return user, fmt.Errorf("missing authorization header")
+	}
+
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	if tokenString == "" {
+		return user, fmt.Errorf("missing bearer token")
+	}
+
+	// Verify token
+	claims, err := utils.ParseAccessToken(config.Get(c).JWT, tokenString)
+	if err != nil {
+		return user, err
+	}
+
+	userID, err := claims.UserID()
+	if err != nil {
+		return user, err
+	}
+
+	if err := db.DB.First(&user, userID).Error; err != nil {
+		return user, err
+	}
+
+	// An access token dies with the session it was issued from
+	if claims.SessionID != "" {
+		session, err := ActiveSession(user.Id, claims.SessionID)
+		if err != nil {
+			return user, fmt.Errorf("session was revoked: %v", err)
+		}
+		c.Locals("session", session)
+	}
+
+	return user, nil
+}
+
+// ActiveSession loads the unused, unexpired refresh token of the user's session family sid,
+// which only exists while the session has not been logged out or revoked
+func ActiveSession(userID uuid.UUID, sid string) (models.Token, error) {
+	var session models.Token
+	err := db.DB.Where("user_id = ? AND family = ? AND used = ? AND expired_at >= ?", userID, sid, false, time.Now()).
+		First(&session).Error
+
+	return session, err
+}
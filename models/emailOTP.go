@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EmailOTP is a one-time code sent by email as a second factor
+type EmailOTP struct {
+	ID          uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID      uuid.UUID  `gorm:"type:uuid;index"`
+	ChallengeID *uuid.UUID `gorm:"type:uuid"` // MFA challenge the code was sent for, empty while enrolling
+	CodeHash    string     // Argon2id hash of the code
+	Used        bool       `gorm:"default:false"`
+	ExpiresAt   time.Time
+	CreatedAt   time.Time
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MFAChallenge is the pending second step of a login that passed the password check
+type MFAChallenge struct {
+	ID         uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID     uuid.UUID `gorm:"type:uuid;index"`
+	RememberMe bool      `gorm:"default:false"`
+	MagicLink  bool      `gorm:"default:false"` // Started from an emailed link, so an emailed code cannot finish it
+	Attempts   int       `gorm:"default:0"`
+	Used       bool      `gorm:"default:false"`
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+}
@@ -2,12 +2,22 @@ package models
 
 import (
 	"github.com/google/uuid"
+	"time"
+)
+
+// Purposes of the single-use tokens sent by email
+const (
+	ResetPurposePassword    = "reset"
+	ResetPurposeMagicLink   = "magic_link"
+	ResetPurposeVerifyEmail = "verify_email"
 )
 
 type Reset struct {
 	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
 	Email     string
 	Token     string `gorm:"unique"`
+	Purpose   string `gorm:"default:'reset'"` // A token is only accepted by the flow it was sent for
 	ExpiresAt int64  // Unix timestamp in milliseconds
 	Used      bool   `gorm:"default:false"`
+	CreatedAt time.Time
 }
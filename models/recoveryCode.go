@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RecoveryCode is a one-time code that stands in for a TOTP code when the authenticator is lost
+type RecoveryCode struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID    uuid.UUID `gorm:"type:uuid;index"`
+	CodeHash  string    // Argon2id hash of the normalized code
+	Used      bool      `gorm:"default:false"`
+	CreatedAt time.Time
+}
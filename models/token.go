@@ -6,8 +6,15 @@ import (
 )
 
 type Token struct {
-	Id        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-	User_id   uuid.UUID `gorm:"type:uuid"` // Changed to UUID type
-	Token     string
-	ExpiredAt time.Time
+	Id         uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	User_id    uuid.UUID `gorm:"type:uuid"`       // Changed to UUID type
+	Family     uuid.UUID `gorm:"type:uuid;index"` // Shared by every token rotated from the same login
+	Token      string
+	Used       bool `gorm:"default:false"` // Set once the token has been rotated
+	ExpiredAt  time.Time
+	UserAgent  string
+	IP         string
+	RememberMe bool      `gorm:"default:false"`
+	CreatedAt  time.Time // When the session was first logged in, carried over on rotation
+	LastUsedAt time.Time
 }
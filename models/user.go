@@ -2,6 +2,7 @@ package models
 
 import (
 	"github.com/google/uuid"
+	"time"
 )
 
 type User struct {
@@ -10,5 +11,20 @@ type User struct {
 	LastName  string    `json:"last_name"`
 	Email     string    `json:"email" gorm:"unique"`
 	Password  []byte    `json:"-"`
-	TFASecret string    `gorm:"column:tfa_secret;default:''"`
+	TFASecret string    `json:"-" gorm:"column:tfa_secret;default:''"`
+
+	EmailVerified   bool       `json:"email_verified" gorm:"default:false"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+
+	// Secret generated by enrollment, only moved to TFASecret once a code from it was confirmed
+	TFAPendingSecret string `json:"-" gorm:"column:tfa_pending_secret;default:''"`
+
+	TFALastStep       int64      `json:"-" gorm:"column:tfa_last_step;default:0"` // Time step of the last accepted code, which can't be reused
+	TFAFailedAttempts int        `json:"-" gorm:"column:tfa_failed_attempts;default:0"`
+	TFALockedUntil    *time.Time `json:"-" gorm:"column:tfa_locked_until"`
+
+	TFAEmailEnabled bool   `json:"-" gorm:"column:tfa_email_enabled;default:false"`
+	TFAMethod       string `json:"-" gorm:"column:tfa_method;default:''"` // Preferred second factor, offered first at login
+
+	WebAuthnCredentials []WebAuthnCredential `json:"-" gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
 }
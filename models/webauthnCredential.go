@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebAuthnCredential is a passkey or security key registered by a user
+type WebAuthnCredential struct {
+	ID              uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID          uuid.UUID `gorm:"type:uuid;index"`
+	Name            string    // Chosen by the user to tell their keys apart
+	CredentialID    []byte    `gorm:"uniqueIndex"`
+	PublicKey       []byte    // COSE encoded
+	AttestationType string
+	Transports      string // Comma separated hints for the browser, such as usb or internal
+	AAGUID          []byte // Identifies the authenticator model
+	SignCount       uint32 // Never goes down unless the key was cloned
+	UserVerified    bool   // Whether registration verified the user with a PIN or biometric
+	BackupEligible  bool
+	BackupState     bool
+	CreatedAt       time.Time
+	LastUsedAt      *time.Time
+}
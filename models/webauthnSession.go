@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Ceremonies a WebAuthnSession can be used for
+const (
+	WebAuthnRegistration     = "registration"
+	WebAuthnSecondFactor     = "second_factor"
+	WebAuthnPasswordless     = "passwordless"
+	WebAuthnReauthentication = "reauthentication"
+)
+
+// WebAuthnSession holds the challenge of a registration or login ceremony between its begin and finish steps
+type WebAuthnSession struct {
+	ID          uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID      *uuid.UUID `gorm:"type:uuid;index"` // Empty for passwordless logins, where the user is not known yet
+	ChallengeID *uuid.UUID `gorm:"type:uuid"`       // MFA challenge a second factor login belongs to
+	Ceremony    string
+	Data        []byte // JSON encoded webauthn.SessionData
+	Used        bool   `gorm:"default:false"`
+	ExpiresAt   time.Time
+	CreatedAt   time.Time
+}
@@ -2,17 +2,60 @@ package routes
 
 import (
 	"github.com/gofiber/fiber/v2"
+	"go-auth/config"
 	"go-auth/controllers"
+	"go-auth/middleware"
 )
 
-func Setup(app *fiber.App) {
+func Setup(app *fiber.App, cfg *config.Config) {
+	app.Use(config.Middleware(cfg))
+
 	app.Post("/api/register", controllers.Register)
 	app.Post("/api/login", controllers.Login)
-	app.Get("/api/user", controllers.AuthenticatedUser)
 	app.Post("/api/refresh", controllers.Refresh)
 	app.Post("/api/logout", controllers.Logout)
+	app.Post("/api/logout-all", controllers.LogoutAll)
 	app.Post("/api/forgot", controllers.ForgotPassword)
 	app.Post("/api/reset", controllers.ResetPassword)
+	app.Post("/api/verify-email", controllers.VerifyEmail)
+	app.Post("/api/verify-email/resend", controllers.ResendVerificationEmail)
+	app.Post("/api/magic-link", controllers.MagicLink)
+	app.Post("/api/magic-link/verify", controllers.VerifyMagicLink)
 	app.Post("/api/two-factor", controllers.TwoFactor)
-	app.Get("/api/test", controllers.QR)
+	app.Post("/api/two-factor/email", controllers.SendTwoFactorEmail)
+	app.Post("/api/two-factor/webauthn/begin", controllers.BeginWebAuthnTwoFactor)
+	app.Post("/api/two-factor/webauthn/finish", controllers.FinishWebAuthnTwoFactor)
+	app.Post("/api/webauthn/login/begin", controllers.BeginPasskeyLogin)
+	app.Post("/api/webauthn/login/finish", controllers.FinishPasskeyLogin)
+	app.Get("/.well-known/jwks.json", controllers.JWKS)
+	app.Post("/api/introspect", controllers.Introspect)
+
+	// Routes below require a valid access token
+	user := app.Group("/api/user", middleware.Authenticated)
+	user.Get("", controllers.AuthenticatedUser)
+	user.Get("/sessions", controllers.Sessions)
+	user.Delete("/sessions/:id", controllers.RevokeSession)
+	user.Post("/2fa/enroll", controllers.EnrollTwoFactor)
+	user.Get("/2fa/qr", controllers.TwoFactorQR)
+	user.Post("/2fa/confirm", controllers.ConfirmTwoFactor)
+	user.Post("/2fa/disable", controllers.DisableTwoFactor)
+	user.Post("/2fa/reset", controllers.ResetTwoFactor)
+	user.Post("/2fa/email/send", controllers.SendReauthenticationEmail)
+	user.Post("/2fa/webauthn/begin", controllers.BeginWebAuthnReauthentication)
+	user.Get("/2fa/recovery-codes", controllers.RecoveryCodes)
+	user.Post("/2fa/recovery-codes", controllers.RegenerateRecoveryCodes)
+	user.Post("/2fa/email/enroll", controllers.EnrollEmailTwoFactor)
+	user.Post("/2fa/email/confirm", controllers.ConfirmEmailTwoFactor)
+	user.Put("/2fa/method", controllers.SetTwoFactorMethod)
+	user.Get("/trusted-devices", controllers.TrustedDevices)
+	user.Delete("/trusted-devices", controllers.RevokeTrustedDevices)
+	user.Delete("/trusted-devices/:id", controllers.RevokeTrustedDevice)
+	user.Post("/webauthn/register/begin", controllers.BeginWebAuthnRegistration)
+	user.Post("/webauthn/register/finish", controllers.FinishWebAuthnRegistration)
+	user.Get("/webauthn/credentials", controllers.WebAuthnCredentials)
+	user.Post("/webauthn/credentials/:id/delete", controllers.DeleteWebAuthnCredential)
+
+	// Routes below require the admin API key
+	admin := app.Group("/api/admin", middleware.Admin)
+	admin.Post("/keys/rotate", controllers.RotateKeys)
 }
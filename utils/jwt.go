@@ -1,26 +1,200 @@
 package utils
 
 import (
-	"os"
+	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"go-auth/config"
 )
 
-func GenerateAccessToken(userID uuid.UUID) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":  userID.String(), // Store UUID as string
-		"exp": time.Now().Add(30 * time.Second).Unix(),
-	})
-	return token.SignedString([]byte(os.Getenv("JWT_SECRET_ACCESS")))
+// Purposes of the tokens that are neither access nor refresh tokens, so one can never stand in for another
+const (
+	PurposeMFAChallenge  = "mfa_challenge"
+	PurposeTrustedDevice = "trusted_device"
+)
+
+// Claims are the claims carried by access, refresh and purpose tokens
+type Claims struct {
+	jwt.RegisteredClaims
+	SessionID string `json:"sid,omitempty"`     // Refresh token family an access token was issued from
+	Purpose   string `json:"purpose,omitempty"` // Empty for access and refresh tokens
+	LegacyID  string `json:"id,omitempty"`      // User ID of tokens issued before "sub" was used
+}
+
+// UserID returns the user the token was issued for
+func (c *Claims) UserID() (uuid.UUID, error) {
+	if c.Subject == "" {
+		return uuid.Parse(c.LegacyID)
+	}
+	return uuid.Parse(c.Subject)
+}
+
+// newClaims fills in the standard claims. The issuer and audience are optional,
+// but once configured they are also required when parsing tokens.
+func newClaims(cfg config.JWT, userID uuid.UUID, ttl time.Duration) Claims {
+	now := time.Now()
+
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID.String(),
+			Issuer:    cfg.Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			ID:        uuid.NewString(), // Also keeps rotated tokens unique even within the same second
+		},
+	}
+	if len(cfg.Audience) > 0 {
+		claims.Audience = cfg.Audience
+	}
+
+	return claims
+}
+
+func GenerateAccessToken(cfg config.JWT, userID, sessionID uuid.UUID, ttl time.Duration) (string, error) {
+	if accessKeys == nil || accessKeys.Active() == nil {
+		return "", fmt.Errorf("access token signing key is not loaded")
+	}
+	key := accessKeys.Active()
+
+	claims := newClaims(cfg, userID, ttl)
+	claims.SessionID = sessionID.String()
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.Sign)
+}
+
+func GenerateRefreshToken(cfg config.JWT, userID uuid.UUID, ttl time.Duration) (string, error) {
+	kid, secrets := refreshSecrets(cfg)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims(cfg, userID, ttl))
+	token.Header["kid"] = kid
+	return token.SignedString(secrets[kid])
+}
+
+// GeneratePurposeToken issues a short-lived token that is only good for one step of a flow,
+// identified by id. It is signed with the refresh secret, which is never shared with other services.
+func GeneratePurposeToken(cfg config.JWT, purpose string, userID, id uuid.UUID, ttl time.Duration) (string, error) {
+	kid, secrets := refreshSecrets(cfg)
+
+	claims := newClaims(cfg, userID, ttl)
+	claims.ID = id.String()
+	claims.Purpose = purpose
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(secrets[kid])
+}
+
+// ParsePurposeToken verifies a token issued by GeneratePurposeToken for the same purpose
+func ParsePurposeToken(cfg config.JWT, purpose, tokenString string) (*Claims, error) {
+	claims, err := parseToken(cfg, tokenString, refreshKeyFunc(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Purpose != purpose {
+		return nil, fmt.Errorf("token was issued for %q", claims.Purpose)
+	}
+
+	return claims, nil
 }
 
-func GenerateRefreshToken(userID uuid.UUID) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":  userID.String(), // Store UUID as string
-		"exp": time.Now().Add(7 * 24 * time.Hour).Unix(),
+// ParseAccessToken verifies an access token against any non-retired key
+func ParseAccessToken(cfg config.JWT, tokenString string) (*Claims, error) {
+	return parseSessionToken(cfg, tokenString, func(token *jwt.Token) (interface{}, error) {
+		if accessKeys == nil {
+			return nil, fmt.Errorf("access token signing key is not loaded")
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, ok := accessKeys.Lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown key id: %v", token.Header["kid"])
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.Verify, nil
 	})
-	return token.SignedString([]byte(os.Getenv("JWT_SECRET_REFRESH")))
 }
 
+// ParseRefreshToken verifies a refresh token against the current or a previous secret
+func ParseRefreshToken(cfg config.JWT, tokenString string) (*Claims, error) {
+	return parseSessionToken(cfg, tokenString, refreshKeyFunc(cfg))
+}
+
+func refreshKeyFunc(cfg config.JWT) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		current, secrets := refreshSecrets(cfg)
+
+		// Tokens issued before key IDs were added were signed with the current secret
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			kid = current
+		}
+
+		secret, ok := secrets[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id: %v", token.Header["kid"])
+		}
+		return secret, nil
+	}
+}
+
+// parseSessionToken parses an access or refresh token, rejecting purpose tokens
+func parseSessionToken(cfg config.JWT, tokenString string, keyFunc jwt.Keyfunc) (*Claims, error) {
+	claims, err := parseToken(cfg, tokenString, keyFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Purpose != "" {
+		return nil, fmt.Errorf("token was issued for %q", claims.Purpose)
+	}
+
+	return claims, nil
+}
+
+func parseToken(cfg config.JWT, tokenString string, keyFunc jwt.Keyfunc) (*Claims, error) {
+	options := []jwt.ParserOption{jwt.WithIssuedAt()}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc, options...)
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	// The token must be meant for at least one of our audiences
+	if len(cfg.Audience) > 0 && !containsAny(claims.Audience, cfg.Audience) {
+		return nil, fmt.Errorf("invalid token audience: %v", claims.Audience)
+	}
+
+	if _, err := claims.UserID(); err != nil {
+		return nil, fmt.Errorf("invalid token subject: %v", err)
+	}
+
+	return claims, nil
+}
+
+func containsAny(values, wanted []string) bool {
+	for _, value := range values {
+		for _, w := range wanted {
+			if value == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,450 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go-auth/config"
+)
+
+// SigningKey is a key used to sign and verify access tokens
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	Sign      interface{} // Private key, or the shared secret for HS256
+	Verify    interface{} // Public key, or the shared secret for HS256
+	CreatedAt time.Time
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// KeyRing holds the active signing key plus the older keys that may still verify tokens
+type KeyRing struct {
+	mu        sync.RWMutex
+	alg       string
+	dir       string        // Where rotated keys are stored, empty when rotation is disabled
+	retention time.Duration // How long a replaced key keeps verifying tokens
+	active    *SigningKey
+	keys      map[string]*SigningKey
+}
+
+// JWKSCacheTTL is how long clients may cache the JWKS. Rotated keys are published this long
+// before they sign tokens, so key sets fetched before a rotation already hold the new key.
+const JWKSCacheTTL = 5 * time.Minute
+
+// accessKeys is shared by every request and updated in place by the rotation goroutine
+var accessKeys *KeyRing
+
+// LoadAccessKeys loads the access token signing keys. HS256 signs with the shared access secret,
+// while the asymmetric algorithms either use a single PEM private key or manage a rotating set
+// of keys in the keys directory.
+func LoadAccessKeys(cfg config.JWT) error {
+	ring := &KeyRing{alg: cfg.SigningAlg, keys: map[string]*SigningKey{}}
+
+	if cfg.SigningAlg == jwt.SigningMethodHS256.Alg() {
+		ring.add(&SigningKey{
+			ID:     cfg.KeyID,
+			Method: jwt.SigningMethodHS256,
+			Sign:   []byte(cfg.SecretAccess),
+			Verify: []byte(cfg.SecretAccess),
+		})
+		accessKeys = ring
+		return nil
+	}
+
+	if cfg.KeysDir != "" {
+		ring.dir = cfg.KeysDir
+		ring.retention = cfg.KeyRetention
+
+		if err := ring.Reload(); err != nil {
+			return err
+		}
+
+		// First start with an empty directory, so create the initial key
+		if ring.Active() == nil {
+			if _, err := ring.Rotate(); err != nil {
+				return err
+			}
+		}
+
+		accessKeys = ring
+		return nil
+	}
+
+	pemBytes := []byte(cfg.PrivateKey)
+	if len(pemBytes) == 0 {
+		if cfg.PrivateKeyFile == "" {
+			return fmt.Errorf("a private key or keys directory is required for %s", cfg.SigningAlg)
+		}
+
+		var err error
+		if pemBytes, err = os.ReadFile(cfg.PrivateKeyFile); err != nil {
+			return err
+		}
+	}
+
+	key, err := ParseSigningKey(cfg.SigningAlg, pemBytes)
+	if err != nil {
+		return err
+	}
+
+	if cfg.KeyID != "" {
+		key.ID = cfg.KeyID
+	}
+
+	ring.add(key)
+	accessKeys = ring
+	return nil
+}
+
+// AccessKeys returns the key ring loaded by LoadAccessKeys
+func AccessKeys() *KeyRing {
+	return accessKeys
+}
+
+// Active returns the key new tokens are signed with
+func (r *KeyRing) Active() *SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.active
+}
+
+// Lookup returns the non-retired key with the given ID
+func (r *KeyRing) Lookup(kid string) (*SigningKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, ok := r.keys[kid]
+	return key, ok
+}
+
+// Keys returns every non-retired key, newest first
+func (r *KeyRing) Keys() []*SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]*SigningKey, 0, len(r.keys))
+	for _, key := range r.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+	return keys
+}
+
+// CanRotate reports whether the ring stores its keys on disk and can therefore rotate them
+func (r *KeyRing) CanRotate() bool {
+	return r.dir != ""
+}
+
+// Rotate generates a new signing key, which is published right away and becomes active once
+// JWKSCacheTTL has passed. The previous keys keep verifying tokens until the retention period
+// after they were replaced has passed.
+func (r *KeyRing) Rotate() (*SigningKey, error) {
+	if !r.CanRotate() {
+		return nil, fmt.Errorf("key rotation requires a keys directory and an asymmetric algorithm")
+	}
+
+	pemBytes, err := generatePrivateKeyPEM(r.alg)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ParseSigningKey(r.alg, pemBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(r.dir, key.ID+".pem"), pemBytes, 0600); err != nil {
+		return nil, err
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	log.Println("Rotated JWT signing key, new key id:", key.ID)
+
+	return key, nil
+}
+
+// Reload rereads the key directory so rotations done by other instances are picked up,
+// dropping keys that were replaced longer ago than the retention period
+func (r *KeyRing) Reload() error {
+	if !r.CanRotate() {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(r.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	var keys []*SigningKey
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		pemBytes, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		key, err := ParseSigningKey(r.alg, pemBytes)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		key.ID = strings.TrimSuffix(filepath.Base(file), ".pem")
+		key.CreatedAt = info.ModTime()
+
+		keys = append(keys, key)
+	}
+
+	// Newest first, so each key is replaced when the one before it in the list becomes active
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.active = nil
+	r.keys = map[string]*SigningKey{}
+	for i, key := range keys {
+		if i > 0 && time.Since(keys[i-1].CreatedAt) > JWKSCacheTTL+r.retention {
+			os.Remove(filepath.Join(r.dir, key.ID+".pem"))
+			continue
+		}
+		r.keys[key.ID] = key
+
+		// The newest key that has been published for long enough signs, or the very first key
+		if r.active == nil && (time.Since(key.CreatedAt) >= JWKSCacheTTL || i == len(keys)-1) {
+			r.active = key
+		}
+	}
+
+	return nil
+}
+
+// StartRotation rotates the signing key whenever it is older than interval (never when it
+// is zero), and reloads the key directory in between to stay in sync with other instances
+func (r *KeyRing) StartRotation(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := r.Reload(); err != nil {
+				log.Println("Failed to reload JWT signing keys:", err)
+				continue
+			}
+
+			if interval <= 0 {
+				continue
+			}
+
+			// Measured from the newest key, which may still be waiting to become active
+			if keys := r.Keys(); len(keys) == 0 || time.Since(keys[0].CreatedAt) >= interval {
+				if _, err := r.Rotate(); err != nil {
+					log.Println("Failed to rotate JWT signing key:", err)
+				}
+			}
+		}
+	}()
+}
+
+func (r *KeyRing) add(key *SigningKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keys[key.ID] = key
+	r.active = key
+}
+
+// ParseSigningKey builds a signing key from a PEM encoded private key,
+// using the RFC 7638 thumbprint of the public key as its ID
+func ParseSigningKey(alg string, pemBytes []byte) (*SigningKey, error) {
+	key := &SigningKey{CreatedAt: time.Now()}
+
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, err
+		}
+		key.Method, key.Sign, key.Verify = jwt.SigningMethodRS256, private, &private.PublicKey
+	case jwt.SigningMethodES256.Alg():
+		private, err := jwt.ParseECPrivateKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, err
+		}
+		if private.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ES256 requires a P-256 key")
+		}
+		key.Method, key.Sign, key.Verify = jwt.SigningMethodES256, private, &private.PublicKey
+	case jwt.SigningMethodEdDSA.Alg():
+		private, err := jwt.ParseEdPrivateKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, err
+		}
+		key.Method, key.Sign, key.Verify = jwt.SigningMethodEdDSA, private, private.(crypto.Signer).Public()
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+
+	thumbprint, err := key.thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	key.ID = thumbprint
+
+	return key, nil
+}
+
+func generatePrivateKeyPEM(alg string) ([]byte, error) {
+	var private interface{}
+	var err error
+
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("cannot generate keys for %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// JWK returns the public half of the key, or false for shared secrets that must never be published
+func (k *SigningKey) JWK() (JWK, bool) {
+	jwk := JWK{Use: "sig", Alg: k.Method.Alg(), Kid: k.ID}
+
+	switch public := k.Verify.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = public.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	default:
+		return jwk, false
+	}
+
+	return jwk, true
+}
+
+func (k *SigningKey) thumbprint() (string, error) {
+	jwk, ok := k.JWK()
+	if !ok {
+		return "", fmt.Errorf("cannot compute a thumbprint for %s", k.Method.Alg())
+	}
+
+	// Only the required members, in lexicographic order (json.Marshal sorts map keys)
+	members := map[string]string{"kty": jwk.Kty}
+	switch jwk.Kty {
+	case "RSA":
+		members["n"], members["e"] = jwk.N, jwk.E
+	case "EC":
+		members["crv"], members["x"], members["y"] = jwk.Crv, jwk.X, jwk.Y
+	case "OKP":
+		members["crv"], members["x"] = jwk.Crv, jwk.X
+	}
+
+	encoded, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(encoded)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// JWKS lists the public keys other services can use to verify access tokens
+func JWKS() []JWK {
+	keys := []JWK{}
+	if accessKeys == nil {
+		return keys
+	}
+
+	for _, key := range accessKeys.Keys() {
+		if jwk, ok := key.JWK(); ok {
+			keys = append(keys, jwk)
+		}
+	}
+
+	return keys
+}
+
+// refreshSecrets returns the refresh token secrets by key ID. The current secret signs
+// new tokens while the previous ones only verify them.
+func refreshSecrets(cfg config.JWT) (string, map[string][]byte) {
+	current := cfg.SecretRefresh
+	secrets := map[string][]byte{secretID(current): []byte(current)}
+
+	for _, previous := range cfg.SecretRefreshPrevious {
+		secrets[secretID(previous)] = []byte(previous)
+	}
+
+	return secretID(current), secrets
+}
+
+// secretID derives a key ID from a shared secret without revealing it
+func secretID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"net/smtp"
+
+	"go-auth/config"
+)
+
+// SendMail renders an HTML template and sends it to a single recipient
+func SendMail(cfg config.SMTP, to, subject, templateFile string, data interface{}) error {
+	// Parse template
+	html, err := ParseTemplate(templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	// Authenticate only when credentials are set, MailHog and local relays accept mail without
+	var auth smtp.Auth
+	if cfg.User != "" && cfg.Password != "" {
+		auth = smtp.PlainAuth("", cfg.User, cfg.Password, cfg.Host)
+	}
+
+	// Email headers
+	mime := "MIME-version: 1.0;\r\nContent-Type: text/html; charset=\"UTF-8\";\r\n\r\n"
+	msg := []byte(
+		"From: " + cfg.From + "\r\n" +
+			"To: " + to + "\r\n" +
+			"Subject: " + subject + "\r\n" +
+			mime +
+			html,
+	)
+
+	// Send email
+	return smtp.SendMail(cfg.Host+":"+cfg.Port, auth, cfg.From, []string{to}, msg)
+}
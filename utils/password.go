@@ -1,57 +1,153 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
-	"crypto/rand"
 	"strings"
 
+	"go-auth/config"
 	"golang.org/x/crypto/argon2"
 )
 
-// Generate a random salt (16 bytes)
-func generateSalt() []byte {
-	salt := make([]byte, 16)
+// argon2Params are the parameters encoded in a stored hash
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+// Generate a random salt
+func generateSalt(length uint32) []byte {
+	salt := make([]byte, length)
 	rand.Read(salt)
 	return salt
 }
 
-// HashPassword hashes a password using Argon2id and returns it in Argon2 standard format
-func HashPassword(password string) string {
-	salt := generateSalt()
+// HashPassword hashes a password using Argon2id with the given parameters and returns it in Argon2 standard format
+func HashPassword(cfg config.Argon2, password string) string {
+	salt := generateSalt(cfg.SaltLength)
 
 	// Hash password using Argon2id
-	hashedPassword := argon2.IDKey([]byte(password), salt, 3, 64*1024, 4, 32)
+	hashedPassword := argon2.IDKey([]byte(password), salt, cfg.Iterations, cfg.Memory, cfg.Parallelism, cfg.KeyLength)
 
 	// Encode salt & hash in base64
-	encodedSalt := base64.StdEncoding.EncodeToString(salt)
-	encodedHash := base64.StdEncoding.EncodeToString(hashedPassword)
+	encodedSalt := base64.RawStdEncoding.EncodeToString(salt)
+	encodedHash := base64.RawStdEncoding.EncodeToString(hashedPassword)
 
 	// Return password in Argon2 standard format
-	return fmt.Sprintf("$argon2id$v=19$m=65536,t=3,p=4$%s$%s", encodedSalt, encodedHash)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, cfg.Memory, cfg.Iterations, cfg.Parallelism, encodedSalt, encodedHash)
+}
+
+// PasswordHasher verifies passwords against hashes of one format
+type PasswordHasher interface {
+	Verify(storedHash, password string) bool
+}
+
+// Hashers by the PHC prefix of the hashes they verify, new hashes are always Argon2id
+var passwordHashers = map[string]PasswordHasher{
+	"$argon2id$": argon2Hasher{},
+	"$2a$":       bcryptHasher{},
+	"$2b$":       bcryptHasher{},
+	"$scrypt$":   scryptHasher{},
+}
+
+// RegisterPasswordHasher adds support for verifying hashes that start with prefix, such as "$2y$"
+func RegisterPasswordHasher(prefix string, hasher PasswordHasher) {
+	passwordHashers[prefix] = hasher
+}
+
+// hashPrefix returns the "$id$" part of a hash
+func hashPrefix(storedHash string) string {
+	if !strings.HasPrefix(storedHash, "$") {
+		return ""
+	}
+	end := strings.Index(storedHash[1:], "$")
+	if end < 0 {
+		return ""
+	}
+	return storedHash[:end+2]
 }
 
-// VerifyPassword checks if the input password matches the stored Argon2 hash
+// VerifyPassword checks if the input password matches the stored hash, in any of the registered formats
 func VerifyPassword(storedHash, inputPassword string) bool {
-	parts := strings.Split(storedHash, "$")
-	if len(parts) != 6 {
-		return false // Invalid hash format
+	hasher, ok := passwordHashers[hashPrefix(storedHash)]
+	if !ok {
+		return false
 	}
+	return hasher.Verify(storedHash, inputPassword)
+}
 
-	// Extract salt & stored hash
-	encodedSalt := parts[4]
-	encodedStoredHash := parts[5]
+type argon2Hasher struct{}
 
-	// Decode salt & hash from base64
-	salt, err1 := base64.StdEncoding.DecodeString(encodedSalt)
-	_, err2 := base64.StdEncoding.DecodeString(encodedStoredHash)
-	if err1 != nil || err2 != nil {
+// Verify checks the password against an Argon2id hash, using the parameters stored with it
+func (argon2Hasher) Verify(storedHash, inputPassword string) bool {
+	params, salt, hash, err := decodeArgon2Hash(storedHash)
+	if err != nil {
 		return false
 	}
 
-	// Hash the input password using the extracted salt
-	newHash := argon2.IDKey([]byte(inputPassword), salt, 3, 64*1024, 4, 32)
+	// Hash the input password with the stored salt and parameters
+	newHash := argon2.IDKey([]byte(inputPassword), salt, params.iterations, params.memory, params.parallelism, uint32(len(hash)))
 
 	// Compare the hashes
-	return base64.StdEncoding.EncodeToString(newHash) == encodedStoredHash
+	return subtle.ConstantTimeCompare(newHash, hash) == 1
+}
+
+// PasswordNeedsRehash reports whether a stored hash is in a legacy format or was made with weaker
+// parameters than cfg, which new hashes get
+func PasswordNeedsRehash(cfg config.Argon2, storedHash string) bool {
+	params, salt, hash, err := decodeArgon2Hash(storedHash)
+	if err != nil {
+		return true
+	}
+
+	return params.memory < cfg.Memory ||
+		params.iterations < cfg.Iterations ||
+		params.parallelism < cfg.Parallelism ||
+		uint32(len(salt)) < cfg.SaltLength ||
+		uint32(len(hash)) < cfg.KeyLength
+}
+
+// decodeArgon2Hash splits "$argon2id$v=19$m=65536,t=3,p=4$salt$hash" into its parts
+func decodeArgon2Hash(encoded string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 version: %v", err)
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters: %v", err)
+	}
+	if params.iterations == 0 || params.parallelism == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters")
+	}
+
+	// Hashes made before the padding was dropped end in "="
+	salt, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(parts[4], "="))
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(parts[5], "="))
+	if err != nil {
+		return params, nil, nil, err
+	}
+	if len(hash) == 0 {
+		return params, nil, nil, fmt.Errorf("empty argon2 hash")
+	}
+
+	return params, salt, hash, nil
 }
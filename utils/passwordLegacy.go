@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Hashes imported from other systems, they are only verified and replaced by Argon2id on the next login
+
+type bcryptHasher struct{}
+
+// Verify checks the password against a "$2a$" or "$2b$" bcrypt hash
+func (bcryptHasher) Verify(storedHash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password)) == nil
+}
+
+type scryptHasher struct{}
+
+// Verify checks the password against a "$scrypt$ln=15,r=8,p=1$salt$hash" hash
+func (scryptHasher) Verify(storedHash, password string) bool {
+	parts := strings.Split(storedHash, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != "scrypt" {
+		return false
+	}
+
+	var logN, r, p int
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil || logN < 1 || logN > 30 {
+		return false
+	}
+
+	salt, err := decodePHCBase64(parts[3])
+	if err != nil {
+		return false
+	}
+	hash, err := decodePHCBase64(parts[4])
+	if err != nil || len(hash) == 0 {
+		return false
+	}
+
+	newHash, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, len(hash))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(newHash, hash) == 1
+}
+
+// decodePHCBase64 decodes unpadded base64, also in the "." for "+" variant passlib writes
+func decodePHCBase64(encoded string) ([]byte, error) {
+	encoded = strings.ReplaceAll(strings.TrimRight(encoded, "="), ".", "+")
+	return base64.RawStdEncoding.DecodeString(encoded)
+}
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nbutton23/zxcvbn-go"
+	"go-auth/config"
+)
+
+// Breached password SHA-1 hashes, grouped like the k-anonymity range API by the first 5 hex
+// characters. Only set when the list is a single file, a directory is read one range at a time.
+var breachedRanges map[string]map[string]struct{}
+
+// LoadBreachedPasswords reads the breached password list of the policy into memory when it is a single file
+func LoadBreachedPasswords(cfg config.PasswordPolicy) error {
+	breachedRanges = nil
+
+	if cfg.BreachedList == "" {
+		return nil
+	}
+
+	info, err := os.Stat(cfg.BreachedList)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	file, err := os.Open(cfg.BreachedList)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	breachedRanges = map[string]map[string]struct{}{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Lines are a full hash, optionally followed by ":count" like the downloadable lists
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if len(hash) != 40 {
+			continue
+		}
+		hash = strings.ToUpper(hash)
+
+		prefix, suffix := hash[:5], hash[5:]
+		if breachedRanges[prefix] == nil {
+			breachedRanges[prefix] = map[string]struct{}{}
+		}
+		breachedRanges[prefix][suffix] = struct{}{}
+	}
+
+	return scanner.Err()
+}
+
+// CheckPassword returns every way the password breaks the policy, nil when it is acceptable.
+// userInputs are the email and names of the account, which the password must not contain.
+func CheckPassword(policy config.PasswordPolicy, password string, userInputs ...string) []FieldError {
+	var problems []FieldError
+	fail := func(rule, message string) {
+		problems = append(problems, FieldError{Field: "password", Rule: rule, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		fail("min", fmt.Sprintf("password must be at least %d characters", policy.MinLength))
+	}
+	if length > policy.MaxLength {
+		fail("max", fmt.Sprintf("password must be at most %d characters", policy.MaxLength))
+		return problems // Too long to be worth scoring
+	}
+
+	if missing := missingClasses(password, policy.RequiredClasses); len(missing) > 0 {
+		fail("character_classes", "password must contain "+strings.Join(missing, ", "))
+	}
+
+	// Both the full email and its local part count
+	var inputs []string
+	for _, input := range userInputs {
+		local, _, _ := strings.Cut(input, "@")
+		inputs = append(inputs, input, local)
+	}
+	for _, input := range inputs {
+		if len(input) >= 3 && strings.Contains(strings.ToLower(password), strings.ToLower(input)) {
+			fail("user_info", "password must not contain your email or name")
+			break
+		}
+	}
+
+	if score := zxcvbn.PasswordStrength(password, inputs).Score; score < policy.MinScore {
+		fail("strength", fmt.Sprintf("password is too easy to guess, it scores %d out of 4 and needs %d", score, policy.MinScore))
+	}
+
+	breached, err := passwordBreached(policy.BreachedList, password)
+	if err != nil {
+		fmt.Println("Failed to check breached passwords:", err)
+	}
+	if breached {
+		fail("breached", "password has appeared in a data breach, choose another one")
+	}
+
+	return problems
+}
+
+func missingClasses(password string, required []string) []string {
+	found := map[string]bool{}
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			found["lower"] = true
+		case unicode.IsUpper(r):
+			found["upper"] = true
+		case unicode.IsDigit(r):
+			found["digit"] = true
+		default:
+			found["symbol"] = true
+		}
+	}
+
+	names := map[string]string{
+		"lower":  "a lowercase letter",
+		"upper":  "an uppercase letter",
+		"digit":  "a digit",
+		"symbol": "a symbol",
+	}
+
+	var missing []string
+	for _, class := range required {
+		if !found[class] {
+			missing = append(missing, names[class])
+		}
+	}
+	return missing
+}
+
+// passwordBreached looks the password's SHA-1 up in its range of the breached password list,
+// which is either loaded in memory or a directory with one file per 5 character prefix
+func passwordBreached(list, password string) (bool, error) {
+	if list == "" {
+		return false, nil
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	if breachedRanges != nil {
+		_, ok := breachedRanges[prefix][suffix]
+		return ok, nil
+	}
+
+	file, err := os.Open(filepath.Join(list, prefix+".txt"))
+	if os.IsNotExist(err) {
+		file, err = os.Open(filepath.Join(list, prefix))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// Range files hold "SUFFIX:count" lines, without the prefix
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"go-auth/config"
+)
+
+// ValidateTOTP checks code against every time step within the allowed skew that is newer than
+// lastStep, returning the matching step so it can be recorded and never accepted again
+func ValidateTOTP(cfg config.TOTP, secret, code string, lastStep int64) (int64, bool) {
+	opts := totp.ValidateOpts{
+		Period:    cfg.Period,
+		Digits:    cfg.Digits,
+		Algorithm: cfg.Algorithm,
+	}
+
+	now := time.Now().UTC()
+	current := now.Unix() / int64(cfg.Period)
+
+	for offset := -int64(cfg.Skew); offset <= int64(cfg.Skew); offset++ {
+		step := current + offset
+		if step <= lastStep {
+			continue
+		}
+
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*int64(cfg.Period), 0).UTC(), opts)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
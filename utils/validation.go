@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError describes one field that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+
+	// Report fields by the name clients send them with
+	v.RegisterTagNameFunc(jsonName)
+
+	return v
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// Validate checks the validate tags of a request struct, returning nil when it is valid
+func Validate(request interface{}) []FieldError {
+	err := validate.Struct(request)
+	if err == nil {
+		return nil
+	}
+
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return []FieldError{{Rule: "invalid", Message: err.Error()}}
+	}
+
+	requestType := reflect.Indirect(reflect.ValueOf(request)).Type()
+
+	fieldErrors := make([]FieldError, len(validationErrors))
+	for i, fe := range validationErrors {
+		fieldErrors[i] = FieldError{
+			Field:   fe.Field(),
+			Rule:    fe.Tag(),
+			Message: validationMessage(requestType, fe),
+		}
+	}
+	return fieldErrors
+}
+
+func validationMessage(requestType reflect.Type, fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return fe.Field() + " is required"
+	case "required_without":
+		return fmt.Sprintf("%s is required unless %s is given", fe.Field(), paramName(requestType, fe.Param()))
+	case "email":
+		return fe.Field() + " must be a valid email address"
+	case "min":
+		return fmt.Sprintf("%s must be at least %s characters", fe.Field(), fe.Param())
+	case "max":
+		return fmt.Sprintf("%s must be at most %s characters", fe.Field(), fe.Param())
+	case "len":
+		return fmt.Sprintf("%s must be %s characters", fe.Field(), fe.Param())
+	case "eqfield":
+		return fmt.Sprintf("%s must match %s", fe.Field(), paramName(requestType, fe.Param()))
+	case "numeric":
+		return fe.Field() + " must contain only digits"
+	case "oneof":
+		return fmt.Sprintf("%s must be one of: %s", fe.Field(), strings.ReplaceAll(fe.Param(), " ", ", "))
+	case "uuid":
+		return fe.Field() + " must be a valid UUID"
+	}
+	return fmt.Sprintf("%s is invalid (%s)", fe.Field(), fe.Tag())
+}
+
+// paramName returns the JSON name of the field a rule such as eqfield refers to
+func paramName(requestType reflect.Type, name string) string {
+	if field, ok := requestType.FieldByName(name); ok {
+		return jsonName(field)
+	}
+	return name
+}